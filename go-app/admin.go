@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// withAdmin restricts h to requests carrying token as a bearer token in
+// the Authorization header.
+func withAdmin(token string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t, ok := strings.CutPrefix(r.Header.Get("authorization"), "Bearer ")
+		if !ok || token == "" || subtle.ConstantTimeCompare([]byte(t), []byte(token)) != 1 {
+			w.Header().Set("www-authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// purgeRequest is the body of admin purge requests.
+type purgeRequest struct {
+	PurgeQuery
+	DryRun bool `json:"dryRun"` // report the keys without purging them
+}
+
+// purgeResponse is the body of admin purge responses.
+type purgeResponse struct {
+	DryRun bool     `json:"dryRun"`
+	Count  int      `json:"count"`
+	Keys   []string `json:"keys"` // cache keys purged, or to purge in dry-run mode
+}
+
+// servePurge purges the cached objects of bucket selected by the JSON
+// purgeRequest body, e.g. {"prefix": "docs/ja/", "dryRun": true}.
+func servePurge(s *Storage, bucket string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req purgeRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+			http.Error(w, "malformed purge request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Prefix == "" && len(req.Objects) == 0 && req.Tag == "" {
+			http.Error(w, "purge request needs a prefix, objects or a tag", http.StatusBadRequest)
+			return
+		}
+		ctx := platform.NewContext(r)
+		keys, err := s.Purge(ctx, bucket, &req.PurgeQuery, req.DryRun)
+		if err != nil {
+			log.Printf("[ERROR] purge %+v: %v", req, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !req.DryRun {
+			log.Printf("[INFO] purged %d keys for %+v", len(keys), req.PurgeQuery)
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Header().Set("cache-control", "no-store")
+		if keys == nil {
+			keys = []string{}
+		}
+		json.NewEncoder(w).Encode(purgeResponse{DryRun: req.DryRun, Count: len(keys), Keys: keys})
+	}
+}
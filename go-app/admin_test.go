@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServePurge(t *testing.T) {
+	ctx := context.Background()
+	s, mem := newTestStorage()
+	s.Cache = &KeyIndex{Cache: NewLRUCache(1 << 20)}
+	mem.Put("goa.design", "docs/ja/index.html", map[string]string{"content-type": "text/html", metaCacheTags: "docs, ja"}, []byte("ja"))
+	mem.Put("goa.design", "docs/ja/guide.html", map[string]string{"content-type": "text/html", metaCacheTags: "docs,ja"}, []byte("guide"))
+	mem.Put("goa.design", "blog/post.html", map[string]string{"content-type": "text/html", metaCacheTags: "blog"}, []byte("post"))
+	names := []string{"docs/ja/", "docs/ja/guide.html", "blog/post.html", "docs/", "docs/style.css"}
+	load := func() {
+		for _, n := range names {
+			o, err := s.OpenFile(ctx, "goa.design", n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.ReadAll(o.Body)
+			o.Body.Close()
+		}
+	}
+	key := func(name string) string { return s.CacheKey(ctx, "goa.design", name) }
+	h := withAdmin("t0ken", servePurge(s, "goa.design"))
+	purge := func(token, body string) (int, *purgeResponse) {
+		t.Helper()
+		r := httptest.NewRequest("POST", "/_admin/purge", strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		h(rec, r)
+		var res purgeResponse
+		if rec.Code == 200 {
+			if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rec.Code, &res
+	}
+	cached := func(name string) bool {
+		_, err := s.Cache.Get(ctx, key(name))
+		return err == nil
+	}
+
+	load()
+	if code, _ := purge("", `{"prefix": "docs/"}`); code != 401 {
+		t.Errorf("no token: got status %d, want 401", code)
+	}
+	if code, _ := purge("wrong", `{"prefix": "docs/"}`); code != 401 {
+		t.Errorf("wrong token: got status %d, want 401", code)
+	}
+	if code, _ := purge("t0ken", `{}`); code != 400 {
+		t.Errorf("empty query: got status %d, want 400", code)
+	}
+
+	code, res := purge("t0ken", `{"prefix": "docs/ja/", "dryRun": true}`)
+	want := []string{key("docs/ja/guide.html"), key("docs/ja/index.html")}
+	if code != 200 || !res.DryRun || res.Count != 2 || strings.Join(res.Keys, " ") != strings.Join(want, " ") {
+		t.Errorf("dry run: got %d %+v, want %v", code, res, want)
+	}
+	if !cached("docs/ja/index.html") {
+		t.Error("dry run purged the cache")
+	}
+
+	if code, res = purge("t0ken", `{"prefix": "/docs/ja/"}`); code != 200 || res.Count != 2 {
+		t.Errorf("prefix: got %d %+v", code, res)
+	}
+	if cached("docs/ja/index.html") || cached("docs/ja/guide.html") || !cached("docs/index.html") {
+		t.Error("prefix: wrong objects purged")
+	}
+
+	load()
+	if code, res = purge("t0ken", `{"tag": "blog"}`); code != 200 || res.Count != 1 || res.Keys[0] != key("blog/post.html") {
+		t.Errorf("tag: got %d %+v", code, res)
+	}
+	if cached("blog/post.html") || !cached("docs/ja/guide.html") {
+		t.Error("tag: wrong objects purged")
+	}
+
+	code, res = purge("t0ken", `{"objects": ["docs/index.html", "docs/style.css"], "dryRun": true}`)
+	if want := []string{key("docs/index.html"), key("docs/style.css")}; code != 200 || strings.Join(res.Keys, " ") != strings.Join(want, " ") {
+		t.Errorf("objects dry run: got %d %+v, want %v", code, res, want)
+	}
+	if code, _ = purge("t0ken", `{"objects": ["docs/index.html", "docs/style.css"]}`); code != 200 {
+		t.Errorf("objects: got status %d", code)
+	}
+	if cached("docs/index.html") || cached("docs/style.css") || !cached("docs/ja/guide.html") {
+		t.Error("objects: wrong objects purged")
+	}
+}
+
+func TestPurgeUnindexed(t *testing.T) {
+	s, _ := newTestStorage()
+	s.Cache = NewLRUCache(1 << 20)
+	if _, err := s.Purge(context.Background(), "goa.design", &PurgeQuery{Prefix: "docs/"}, true); err == nil {
+		t.Error("prefix purge of an unindexed cache: expected error")
+	}
+	keys, err := s.Purge(context.Background(), "goa.design", &PurgeQuery{Objects: []string{"docs/style.css"}}, false)
+	if err != nil || len(keys) == 0 {
+		t.Errorf("objects purge of an unindexed cache: got %v, %v", keys, err)
+	}
+}
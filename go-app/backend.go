@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// Google Cloud Storage OAuth2 scopes.
+const scopeStorageRead = "https://www.googleapis.com/auth/devstorage.read_only"
+
+// Backend retrieves objects from an object store.
+// Implementations return a *FetchError when the store responds with an
+// error code, e.g. 404 for nonexistent objects.
+type Backend interface {
+	// Open retrieves object name of the bucket.
+	// The caller must close the returned Object.Body.
+	Open(ctx context.Context, bucket, name string) (*Object, error)
+	// Stat retrieves the metadata of object name of the bucket.
+	// The returned Object.Body may be nil.
+	Stat(ctx context.Context, bucket, name string) (*Object, error)
+	// List returns the names of the objects of the bucket starting with
+	// prefix, in lexicographical order.
+	List(ctx context.Context, bucket, prefix string) ([]string, error)
+}
+
+// ErrNotModified is returned by ConditionalBackend.OpenIfNoneMatch when
+// the object has not changed.
+var ErrNotModified = errors.New("not modified")
+
+// ConditionalBackend is a Backend supporting conditional retrieval of
+// objects, e.g. to revalidate cached objects without downloading them.
+type ConditionalBackend interface {
+	Backend
+	// OpenIfNoneMatch retrieves object name of the bucket if its current
+	// entity tag differs from etag, and returns ErrNotModified otherwise.
+	OpenIfNoneMatch(ctx context.Context, bucket, name, etag string) (*Object, error)
+}
+
+// RangeBackend is a Backend supporting the retrieval of object byte ranges.
+type RangeBackend interface {
+	Backend
+	// OpenRange retrieves the byte range rng, a Range header value, of
+	// object name of the bucket. The returned Object.Meta has a
+	// content-range if the backend honored the range, otherwise
+	// Object.Body holds the whole object.
+	OpenRange(ctx context.Context, bucket, name, rng string) (*Object, error)
+}
+
+// GCSBackend is a Backend retrieving objects from Google Cloud Storage.
+type GCSBackend struct {
+	Base string // GCS service base URL, e.g. "https://storage.googleapis.com".
+}
+
+// Open retrieves object name of the bucket with a GET request.
+func (g *GCSBackend) Open(ctx context.Context, bucket, name string) (*Object, error) {
+	return fetch(ctx, fmt.Sprintf("%s/%s", g.Base, path.Join(bucket, name)), nil)
+}
+
+// OpenIfNoneMatch retrieves object name of the bucket with a conditional
+// GET request.
+func (g *GCSBackend) OpenIfNoneMatch(ctx context.Context, bucket, name, etag string) (*Object, error) {
+	h := http.Header{"If-None-Match": {etag}}
+	return fetch(ctx, fmt.Sprintf("%s/%s", g.Base, path.Join(bucket, name)), h)
+}
+
+// Stat retrieves object name of the bucket with a HEAD request.
+func (g *GCSBackend) Stat(ctx context.Context, bucket, name string) (*Object, error) {
+	u := fmt.Sprintf("%s/%s", g.Base, path.Join(bucket, name))
+	req, err := http.NewRequestWithContext(ctx, "HEAD", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := httpClient(ctx, scopeStorageRead).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(res.Body)
+		return nil, &FetchError{
+			Msg:  fmt.Sprintf("%s: %s", res.Status, b),
+			Code: res.StatusCode,
+		}
+	}
+	return &Object{Meta: objectMeta(res.Header), Size: res.ContentLength}, nil
+}
+
+// OpenRange retrieves a byte range of object name of the bucket with a
+// GET request.
+func (g *GCSBackend) OpenRange(ctx context.Context, bucket, name, rng string) (*Object, error) {
+	h := http.Header{"Range": {rng}}
+	return fetch(ctx, fmt.Sprintf("%s/%s", g.Base, path.Join(bucket, name)), h)
+}
+
+// List lists the objects of the bucket using the GCS JSON API, see
+// https://cloud.google.com/storage/docs/json_api/v1/objects/list.
+func (g *GCSBackend) List(ctx context.Context, bucket, prefix string) ([]string, error) {
+	var names []string
+	q := url.Values{"prefix": {prefix}, "fields": {"items/name,nextPageToken"}}
+	for {
+		u := fmt.Sprintf("%s/storage/v1/b/%s/o?%s", g.Base, url.PathEscape(bucket), q.Encode())
+		req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+		if err != nil {
+			return nil, err
+		}
+		res, err := httpClient(ctx, scopeStorageRead).Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode != http.StatusOK {
+			b, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			return nil, &FetchError{
+				Msg:  fmt.Sprintf("%s: %s", res.Status, b),
+				Code: res.StatusCode,
+			}
+		}
+		var page struct {
+			Items []struct {
+				Name string `json:"name"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&page)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, it := range page.Items {
+			names = append(names, it.Name)
+		}
+		if page.NextPageToken == "" {
+			return names, nil
+		}
+		q.Set("pageToken", page.NextPageToken)
+	}
+}
+
+// fetch retrieves object from the given url, adding header h to the request.
+// The returned error will be of type FetchError if the storage responds
+// with an error code, or ErrNotModified for conditional requests.
+func fetch(ctx context.Context, url string, h http.Header) (*Object, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range h {
+		req.Header[k] = v
+	}
+	res, err := httpClient(ctx, scopeStorageRead).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotModified {
+		res.Body.Close()
+		return nil, ErrNotModified
+	}
+	if res.StatusCode > 399 {
+		// FetchError takes precedence over i/o errors
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return nil, &FetchError{
+			Msg:  fmt.Sprintf("%s: %s", res.Status, b),
+			Code: res.StatusCode,
+		}
+	}
+	o := &Object{
+		Meta: objectMeta(res.Header),
+		Body: res.Body,
+		Size: res.ContentLength,
+	}
+	return o, nil
+}
+
+// objectMeta returns the objectHeaders found in h.
+func objectMeta(h http.Header) map[string]string {
+	m := make(map[string]string)
+	for _, k := range objectHeaders {
+		if v := h.Get(k); v != "" {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+func httpClient(ctx context.Context, scopes ...string) *http.Client {
+	t := &oauth2.Transport{
+		Source: AETokenSource(ctx, scopes...),
+		Base:   platform.Transport(ctx),
+	}
+	return &http.Client{Transport: t}
+}
+
+// AETokenSource returns App Engine OAuth2 token source
+// given a context.Context and a slice of scopes.
+// It is a stubbed static token source during testing.
+var AETokenSource = func(ctx context.Context, scope ...string) oauth2.TokenSource {
+	ts, err := google.DefaultTokenSource(ctx, scope...)
+	if err != nil {
+		panic(err)
+	}
+	return ts
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DirBackend is a Backend reading objects from a local directory such as
+// the hugo "public" output directory. The bucket name is ignored: object
+// names are resolved relative to Root. Objects carry no custom metadata.
+type DirBackend struct {
+	Root string
+}
+
+// Open opens the file of object name.
+func (d *DirBackend) Open(ctx context.Context, bucket, name string) (*Object, error) {
+	f, err := os.Open(d.filename(name))
+	if err != nil {
+		return nil, dirError(name, err)
+	}
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		f.Close()
+		return nil, &FetchError{Msg: name + ": not a file", Code: http.StatusNotFound}
+	}
+	return &Object{Meta: fileMeta(fi), Body: f, Size: fi.Size()}, nil
+}
+
+// Stat returns the metadata of the file of object name.
+func (d *DirBackend) Stat(ctx context.Context, bucket, name string) (*Object, error) {
+	fi, err := os.Stat(d.filename(name))
+	if err != nil {
+		return nil, dirError(name, err)
+	}
+	if fi.IsDir() {
+		return nil, &FetchError{Msg: name + ": not a file", Code: http.StatusNotFound}
+	}
+	return &Object{Meta: fileMeta(fi), Size: fi.Size()}, nil
+}
+
+// List walks Root and returns the names of the files starting with prefix.
+func (d *DirBackend) List(ctx context.Context, bucket, prefix string) ([]string, error) {
+	var names []string
+	err := filepath.WalkDir(d.Root, func(p string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if e.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(d.Root, p)
+		if err != nil {
+			return err
+		}
+		if name := filepath.ToSlash(rel); strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (d *DirBackend) filename(name string) string {
+	return filepath.Join(d.Root, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+// fileMeta returns the object metadata of a file, deriving the content type
+// from the file extension.
+func fileMeta(fi os.FileInfo) map[string]string {
+	m := map[string]string{
+		"etag":          fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size()),
+		"last-modified": fi.ModTime().UTC().Format(http.TimeFormat),
+	}
+	if ct := mime.TypeByExtension(path.Ext(fi.Name())); ct != "" {
+		m["content-type"] = ct
+	}
+	return m
+}
+
+// dirError converts a file system error into a FetchError where possible.
+func dirError(name string, err error) error {
+	switch {
+	case os.IsNotExist(err), errors.Is(err, syscall.ENOTDIR):
+		return &FetchError{Msg: name + ": not found", Code: http.StatusNotFound}
+	case os.IsPermission(err):
+		return &FetchError{Msg: name + ": forbidden", Code: http.StatusForbidden}
+	}
+	return err
+}
+
+// MemBackend is a Backend holding objects in memory, keyed by bucket and
+// name. It is safe for concurrent use. The zero value is an empty store.
+type MemBackend struct {
+	mu      sync.RWMutex
+	objects map[string]*memObject
+}
+
+type memObject struct {
+	meta map[string]string
+	body []byte
+}
+
+// Put stores an object with the given metadata and body.
+// The object entity tag defaults to a hash of body.
+func (m *MemBackend) Put(bucket, name string, meta map[string]string, body []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.objects == nil {
+		m.objects = make(map[string]*memObject)
+	}
+	mm := make(map[string]string, len(meta)+1)
+	for k, v := range meta {
+		mm[k] = v
+	}
+	if _, ok := mm["last-modified"]; !ok {
+		mm["last-modified"] = time.Now().UTC().Format(http.TimeFormat)
+	}
+	if _, ok := mm["etag"]; !ok {
+		mm["etag"] = fmt.Sprintf(`"%x"`, md5.Sum(body))
+	}
+	m.objects[path.Join(bucket, name)] = &memObject{meta: mm, body: body}
+}
+
+// Delete removes an object. It is a no-op if the object does not exist.
+func (m *MemBackend) Delete(bucket, name string) {
+	m.mu.Lock()
+	delete(m.objects, path.Join(bucket, name))
+	m.mu.Unlock()
+}
+
+// Open returns a copy of the stored object.
+func (m *MemBackend) Open(ctx context.Context, bucket, name string) (*Object, error) {
+	return m.OpenIfNoneMatch(ctx, bucket, name, "")
+}
+
+// OpenIfNoneMatch returns a copy of the stored object unless its entity tag
+// is etag.
+func (m *MemBackend) OpenIfNoneMatch(ctx context.Context, bucket, name, etag string) (*Object, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	o, body, err := m.object(bucket, name)
+	if err != nil {
+		return nil, err
+	}
+	if etag != "" && o.Meta["etag"] == etag {
+		return nil, ErrNotModified
+	}
+	o.Body = newBytesBody(body)
+	return o, nil
+}
+
+// Stat returns a copy of the stored object metadata.
+func (m *MemBackend) Stat(ctx context.Context, bucket, name string) (*Object, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	o, _, err := m.object(bucket, name)
+	return o, err
+}
+
+// object returns a copy of the metadata of the stored object and its body.
+// The caller must hold m.mu.
+func (m *MemBackend) object(bucket, name string) (*Object, []byte, error) {
+	mo, ok := m.objects[path.Join(bucket, name)]
+	if !ok {
+		return nil, nil, &FetchError{Msg: name + ": not found", Code: http.StatusNotFound}
+	}
+	meta := make(map[string]string, len(mo.meta))
+	for k, v := range mo.meta {
+		meta[k] = v
+	}
+	return &Object{Meta: meta, Size: int64(len(mo.body))}, mo.body, nil
+}
+
+// List returns the names of the stored objects of the bucket starting
+// with prefix.
+func (m *MemBackend) List(ctx context.Context, bucket, prefix string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var names []string
+	for k := range m.objects {
+		name, ok := strings.CutPrefix(k, bucket+"/")
+		if ok && strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
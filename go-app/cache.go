@@ -0,0 +1,526 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/appengine/v2/memcache"
+)
+
+// ErrCacheMiss is returned by Cache.Get when the key is not cached.
+var ErrCacheMiss = errors.New("cache miss")
+
+// ErrNotStored is returned by Adder.Add when the key is already cached.
+var ErrNotStored = errors.New("cache item not stored")
+
+// Cache is a key-value store for serialized objects.
+type Cache interface {
+	// Get returns the value cached under key, or ErrCacheMiss.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Set caches value under key for the given duration.
+	// A zero expiry means no expiration.
+	Set(ctx context.Context, key string, value []byte, expiry time.Duration) error
+	// Delete removes key from the cache.
+	// It does not return an error in the case of cache miss.
+	Delete(ctx context.Context, key string) error
+	// Flush removes all keys from the cache.
+	Flush(ctx context.Context) error
+}
+
+// Adder is a Cache which can store a value only if its key is not cached,
+// atomically across the instances sharing the cache. It is used to hold
+// leases, see acquireLease.
+type Adder interface {
+	// Add caches value under key unless key is already cached, in which
+	// case it returns ErrNotStored.
+	Add(ctx context.Context, key string, value []byte, expiry time.Duration) error
+}
+
+// MultiGetter is a Cache which can get several values in a single round
+// trip.
+type MultiGetter interface {
+	// GetMulti returns the values cached under keys, by key. Keys not
+	// cached are missing from the result.
+	GetMulti(ctx context.Context, keys []string) (map[string][]byte, error)
+}
+
+// getMultiBatch is the max number of keys read by a GetMulti call of
+// getMulti, bounding the size of its response.
+const getMultiBatch = 16
+
+// getMulti returns the values cached in c under keys, by key, with GetMulti
+// if c is a MultiGetter. Keys not cached are missing from the result.
+func getMulti(ctx context.Context, c Cache, keys []string) (map[string][]byte, error) {
+	values := make(map[string][]byte, len(keys))
+	mg, ok := c.(MultiGetter)
+	if !ok {
+		for _, k := range keys {
+			v, err := c.Get(ctx, k)
+			if err == ErrCacheMiss {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			values[k] = v
+		}
+		return values, nil
+	}
+	for len(keys) > 0 {
+		n := min(len(keys), getMultiBatch)
+		vs, err := mg.GetMulti(ctx, keys[:n])
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range vs {
+			values[k] = v
+		}
+		keys = keys[n:]
+	}
+	return values, nil
+}
+
+// acquireLease takes the lease key of c for ttl and reports whether it
+// got it. Caches which are not Adders can't hold leases and always grant
+// them. The lease is released by deleting key.
+func acquireLease(ctx context.Context, c Cache, key string, ttl time.Duration) bool {
+	a, ok := c.(Adder)
+	if !ok {
+		return true
+	}
+	err := a.Add(ctx, key, []byte{1}, ttl)
+	if err != nil && err != ErrNotStored {
+		log.Printf("[ERROR] cache.Add(%q): %v", key, err)
+		// don't let a failing cache block fetches
+		return true
+	}
+	return err == nil
+}
+
+// NewCache returns the Cache of the given kind: "memcache", "lru", "redis"
+// or "none". An empty kind selects memcache on App Engine and lru
+// otherwise. A nil Cache disables caching. The returned caches are
+// IndexedCaches.
+//
+// The lru cache holds at most CACHE_LRU_BYTES bytes, 64 MiB by default.
+// The redis cache connects to the server at REDIS_ADDR.
+func NewCache(kind string) (Cache, error) {
+	c, err := newCache(kind)
+	if c == nil || err != nil {
+		return nil, err
+	}
+	return &KeyIndex{Cache: c}, nil
+}
+
+// sharedCache reports whether c is shared by the instances of the app,
+// unlike the in-process lru cache. Evictions from a cache that isn't
+// shared only apply to the instance evicting.
+func sharedCache(c Cache) bool {
+	if ki, ok := c.(*KeyIndex); ok {
+		c = ki.Cache
+	}
+	_, local := c.(*LRUCache)
+	return c != nil && !local
+}
+
+func newCache(kind string) (Cache, error) {
+	if kind == "" {
+		kind = "lru"
+		if platform.Memcache {
+			kind = "memcache"
+		}
+	}
+	switch kind {
+	case "none":
+		return nil, nil
+	case "memcache":
+		if !platform.Memcache {
+			return nil, fmt.Errorf("memcache is not available on this platform")
+		}
+		return newMemcache(), nil
+	case "lru":
+		size := int64(64 << 20)
+		if v := os.Getenv("CACHE_LRU_BYTES"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid CACHE_LRU_BYTES %q", v)
+			}
+			size = n
+		}
+		return NewLRUCache(size), nil
+	case "redis":
+		addr := os.Getenv("REDIS_ADDR")
+		if addr == "" {
+			return nil, fmt.Errorf("REDIS_ADDR not set")
+		}
+		return &RedisCache{Client: redis.NewClient(&redis.Options{Addr: addr})}, nil
+	}
+	return nil, fmt.Errorf("unknown cache %q", kind)
+}
+
+// Memcache is a Cache backed by the App Engine memcache service.
+// Its items are limited to cacheItemMax bytes, see newMemcache.
+type Memcache struct{}
+
+// newMemcache returns a memcache Cache storing large values in chunks.
+func newMemcache() Cache {
+	// leave room for the item key and overhead
+	return &ChunkedCache{Cache: Memcache{}, ChunkSize: cacheItemMax - 1<<10}
+}
+
+// Get implements Cache.
+func (Memcache) Get(ctx context.Context, key string) ([]byte, error) {
+	item, err := memcache.Get(ctx, key)
+	if err == memcache.ErrCacheMiss {
+		return nil, ErrCacheMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+	return item.Value, nil
+}
+
+// GetMulti implements MultiGetter.
+func (Memcache) GetMulti(ctx context.Context, keys []string) (map[string][]byte, error) {
+	items, err := memcache.GetMulti(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string][]byte, len(items))
+	for k, item := range items {
+		values[k] = item.Value
+	}
+	return values, nil
+}
+
+// Set implements Cache.
+func (Memcache) Set(ctx context.Context, key string, value []byte, expiry time.Duration) error {
+	return memcache.Set(ctx, &memcache.Item{Key: key, Value: value, Expiration: expiry})
+}
+
+// Add implements Adder.
+func (Memcache) Add(ctx context.Context, key string, value []byte, expiry time.Duration) error {
+	err := memcache.Add(ctx, &memcache.Item{Key: key, Value: value, Expiration: expiry})
+	if err == memcache.ErrNotStored {
+		err = ErrNotStored
+	}
+	return err
+}
+
+// Delete implements Cache.
+func (Memcache) Delete(ctx context.Context, key string) error {
+	err := memcache.Delete(ctx, key)
+	if err == memcache.ErrCacheMiss {
+		err = nil
+	}
+	return err
+}
+
+// Flush implements Cache.
+func (Memcache) Flush(ctx context.Context) error {
+	return memcache.Flush(ctx)
+}
+
+// LRUCache is an in-process Cache bounded by the total size of its values.
+// The least recently used values are evicted first. It is safe for
+// concurrent use.
+type LRUCache struct {
+	maxBytes int64
+
+	mu    sync.Mutex
+	bytes int64
+	ll    *list.List // of *lruEntry, most recently used first
+	items map[string]*list.Element
+}
+
+type lruEntry struct {
+	key     string
+	value   []byte
+	expires time.Time // zero means no expiration
+}
+
+// NewLRUCache returns an LRUCache holding at most maxBytes bytes of values.
+func NewLRUCache(maxBytes int64) *LRUCache {
+	return &LRUCache{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// Get implements Cache.
+func (c *LRUCache) Get(ctx context.Context, key string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+	e := el.Value.(*lruEntry)
+	if !e.expires.IsZero() && time.Now().After(e.expires) {
+		c.remove(el)
+		return nil, ErrCacheMiss
+	}
+	c.ll.MoveToFront(el)
+	return e.value, nil
+}
+
+// Set implements Cache. Values larger than the cache are not stored.
+func (c *LRUCache) Set(ctx context.Context, key string, value []byte, expiry time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.set(key, value, expiry)
+	return nil
+}
+
+// Add implements Adder.
+func (c *LRUCache) Add(ctx context.Context, key string, value []byte, expiry time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*lruEntry)
+		if e.expires.IsZero() || time.Now().Before(e.expires) {
+			return ErrNotStored
+		}
+	}
+	c.set(key, value, expiry)
+	return nil
+}
+
+// set stores value under key. c.mu must be held.
+func (c *LRUCache) set(key string, value []byte, expiry time.Duration) {
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+	if int64(len(value)) > c.maxBytes {
+		return
+	}
+	e := &lruEntry{key: key, value: value}
+	if expiry > 0 {
+		e.expires = time.Now().Add(expiry)
+	}
+	c.items[key] = c.ll.PushFront(e)
+	c.bytes += int64(len(value))
+	for c.bytes > c.maxBytes {
+		c.remove(c.ll.Back())
+	}
+}
+
+// Delete implements Cache.
+func (c *LRUCache) Delete(ctx context.Context, key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+	return nil
+}
+
+// Flush implements Cache.
+func (c *LRUCache) Flush(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+	c.bytes = 0
+	return nil
+}
+
+// remove must be called with c.mu held.
+func (c *LRUCache) remove(el *list.Element) {
+	e := c.ll.Remove(el).(*lruEntry)
+	delete(c.items, e.key)
+	c.bytes -= int64(len(e.value))
+}
+
+// RedisCache is a Cache backed by a Redis server.
+type RedisCache struct {
+	Client *redis.Client
+}
+
+// Get implements Cache.
+func (c *RedisCache) Get(ctx context.Context, key string) ([]byte, error) {
+	b, err := c.Client.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil, ErrCacheMiss
+	}
+	return b, err
+}
+
+// GetMulti implements MultiGetter.
+func (c *RedisCache) GetMulti(ctx context.Context, keys []string) (map[string][]byte, error) {
+	vs, err := c.Client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string][]byte, len(vs))
+	for i, v := range vs {
+		if s, ok := v.(string); ok {
+			values[keys[i]] = []byte(s)
+		}
+	}
+	return values, nil
+}
+
+// Set implements Cache.
+func (c *RedisCache) Set(ctx context.Context, key string, value []byte, expiry time.Duration) error {
+	return c.Client.Set(ctx, key, value, expiry).Err()
+}
+
+// Add implements Adder.
+func (c *RedisCache) Add(ctx context.Context, key string, value []byte, expiry time.Duration) error {
+	ok, err := c.Client.SetNX(ctx, key, value, expiry).Result()
+	if err == nil && !ok {
+		err = ErrNotStored
+	}
+	return err
+}
+
+// Delete implements Cache.
+func (c *RedisCache) Delete(ctx context.Context, key string) error {
+	return c.Client.Del(ctx, key).Err()
+}
+
+// Flush implements Cache. It flushes the whole Redis database, so the
+// database should be dedicated to the app.
+func (c *RedisCache) Flush(ctx context.Context) error {
+	return c.Client.FlushDB(ctx).Err()
+}
+
+// ChunkedCache is a Cache storing values larger than ChunkSize as several
+// chunk items and a manifest item listing them, for caches such as memcache
+// which limit the size of items.
+type ChunkedCache struct {
+	Cache
+	ChunkSize int // max value size of an item of Cache
+}
+
+// Values stored by ChunkedCache start with one of these markers.
+const (
+	chunkedValue    = 'v' // the value follows
+	chunkedManifest = 'm' // a gob encoded chunkManifest follows
+)
+
+// chunkManifest describes a value split into chunks.
+type chunkManifest struct {
+	ID     string // hex encoded prefix of Sum, distinguishes chunks of successive values
+	Chunks int
+	Size   int
+	Sum    [sha256.Size]byte
+}
+
+func (m *chunkManifest) chunkKey(key string, i int) string {
+	return fmt.Sprintf("%s#%s.%d", key, m.ID, i)
+}
+
+// Get implements Cache. Chunked values are reassembled and verified against
+// the manifest checksum. Incomplete or corrupted values are reported as
+// cache misses. The chunks are read with GetMulti if Cache is a
+// MultiGetter.
+func (c *ChunkedCache) Get(ctx context.Context, key string) ([]byte, error) {
+	v, err := c.Cache.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(v) == 0 {
+		return nil, ErrCacheMiss
+	}
+	switch v[0] {
+	case chunkedValue:
+		return v[1:], nil
+	case chunkedManifest:
+	default:
+		return nil, ErrCacheMiss
+	}
+	var m chunkManifest
+	if err := gob.NewDecoder(bytes.NewReader(v[1:])).Decode(&m); err != nil {
+		return nil, ErrCacheMiss
+	}
+	keys := make([]string, m.Chunks)
+	for i := range keys {
+		keys[i] = m.chunkKey(key, i)
+	}
+	chunks, err := getMulti(ctx, c.Cache, keys)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 0, m.Size)
+	for _, k := range keys {
+		chunk, ok := chunks[k]
+		if !ok {
+			// a chunk was evicted, the value is gone
+			c.Cache.Delete(ctx, key)
+			return nil, ErrCacheMiss
+		}
+		b = append(b, chunk...)
+	}
+	if len(b) != m.Size || sha256.Sum256(b) != m.Sum {
+		log.Printf("[ERROR] cache: corrupted chunked value %q", key)
+		c.Delete(ctx, key)
+		return nil, ErrCacheMiss
+	}
+	return b, nil
+}
+
+// Set implements Cache. The chunks are stored before the manifest so that
+// readers never see a manifest referring to missing chunks of a value being
+// stored.
+func (c *ChunkedCache) Set(ctx context.Context, key string, value []byte, expiry time.Duration) error {
+	if len(value) < c.ChunkSize {
+		return c.Cache.Set(ctx, key, append([]byte{chunkedValue}, value...), expiry)
+	}
+	m := chunkManifest{
+		Chunks: (len(value) + c.ChunkSize - 1) / c.ChunkSize,
+		Size:   len(value),
+		Sum:    sha256.Sum256(value),
+	}
+	m.ID = hex.EncodeToString(m.Sum[:6])
+	for i := 0; i < m.Chunks; i++ {
+		chunk := value[i*c.ChunkSize : min((i+1)*c.ChunkSize, len(value))]
+		if err := c.Cache.Set(ctx, m.chunkKey(key, i), chunk, expiry); err != nil {
+			return err
+		}
+	}
+	var b bytes.Buffer
+	b.WriteByte(chunkedManifest)
+	if err := gob.NewEncoder(&b).Encode(&m); err != nil {
+		return err
+	}
+	return c.Cache.Set(ctx, key, b.Bytes(), expiry)
+}
+
+// Add implements Adder for values smaller than ChunkSize, if Cache is an
+// Adder.
+func (c *ChunkedCache) Add(ctx context.Context, key string, value []byte, expiry time.Duration) error {
+	a, ok := c.Cache.(Adder)
+	if !ok || len(value) >= c.ChunkSize {
+		return fmt.Errorf("chunked cache: can't add %q", key)
+	}
+	return a.Add(ctx, key, append([]byte{chunkedValue}, value...), expiry)
+}
+
+// Delete implements Cache. It removes the chunks of a chunked value along
+// with its manifest.
+func (c *ChunkedCache) Delete(ctx context.Context, key string) error {
+	if v, err := c.Cache.Get(ctx, key); err == nil && len(v) > 0 && v[0] == chunkedManifest {
+		var m chunkManifest
+		if gob.NewDecoder(bytes.NewReader(v[1:])).Decode(&m) == nil {
+			for i := 0; i < m.Chunks; i++ {
+				c.Cache.Delete(ctx, m.chunkKey(key, i))
+			}
+		}
+	}
+	return c.Cache.Delete(ctx, key)
+}
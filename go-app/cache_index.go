@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// indexShards is the number of items the key index of KeyIndex is split
+// into, limiting the size of each item and contention between updates.
+const indexShards = 16
+
+// indexKeyPrefix prefixes the keys of the key index items.
+const indexKeyPrefix = "keyindex#"
+
+// IndexedCache is a Cache which can list its keys by prefix or tag.
+type IndexedCache interface {
+	Cache
+	// SetTagged is like Set and associates tags with key.
+	SetTagged(ctx context.Context, key string, value []byte, expiry time.Duration, tags []string) error
+	// Keys returns the keys starting with prefix, in lexical order.
+	Keys(ctx context.Context, prefix string) ([]string, error)
+	// Tagged returns the keys associated with tag, in lexical order.
+	Tagged(ctx context.Context, tag string) ([]string, error)
+}
+
+// KeyIndex is an IndexedCache maintaining an index of the keys of Cache,
+// for caches such as memcache which can't enumerate their keys. The index
+// is stored in Cache itself. Keys may outlive their value in the index,
+// e.g. when evicted, and updates of the index racing across instances may
+// lose keys, so that listings are best effort. Concurrent updates of a
+// shard are batched, and internal keys such as fetch leases are not
+// indexed.
+type KeyIndex struct {
+	Cache
+
+	mu       sync.Mutex
+	pending  map[string]map[string]*indexEntry // updates by shard, nil entries delete their key
+	flushing map[string]bool                   // shards being written
+}
+
+// indexEntry is the index entry of a key.
+type indexEntry struct {
+	Tags    []string
+	Expires time.Time // zero means no expiration
+}
+
+// Set implements Cache.
+func (c *KeyIndex) Set(ctx context.Context, key string, value []byte, expiry time.Duration) error {
+	return c.SetTagged(ctx, key, value, expiry, nil)
+}
+
+// SetTagged implements IndexedCache.
+func (c *KeyIndex) SetTagged(ctx context.Context, key string, value []byte, expiry time.Duration, tags []string) error {
+	if err := c.Cache.Set(ctx, key, value, expiry); err != nil {
+		return err
+	}
+	if unindexed(key) {
+		return nil
+	}
+	e := &indexEntry{Tags: tags}
+	if expiry > 0 {
+		e.Expires = time.Now().Add(expiry)
+	}
+	return c.update(ctx, key, e)
+}
+
+// Add implements Adder if Cache is an Adder. Added keys, such as
+// leases, are not indexed.
+func (c *KeyIndex) Add(ctx context.Context, key string, value []byte, expiry time.Duration) error {
+	a, ok := c.Cache.(Adder)
+	if !ok {
+		return fmt.Errorf("key index: can't add %q", key)
+	}
+	return a.Add(ctx, key, value, expiry)
+}
+
+// Delete implements Cache.
+func (c *KeyIndex) Delete(ctx context.Context, key string) error {
+	if err := c.Cache.Delete(ctx, key); err != nil {
+		return err
+	}
+	if unindexed(key) {
+		return nil
+	}
+	return c.update(ctx, key, nil)
+}
+
+// Keys implements IndexedCache.
+func (c *KeyIndex) Keys(ctx context.Context, prefix string) ([]string, error) {
+	return c.list(ctx, func(key string, e indexEntry) bool {
+		return strings.HasPrefix(key, prefix)
+	})
+}
+
+// Tagged implements IndexedCache.
+func (c *KeyIndex) Tagged(ctx context.Context, tag string) ([]string, error) {
+	return c.list(ctx, func(key string, e indexEntry) bool {
+		for _, t := range e.Tags {
+			if t == tag {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// list returns the unexpired keys of the index matching the filter.
+func (c *KeyIndex) list(ctx context.Context, match func(string, indexEntry) bool) ([]string, error) {
+	now := time.Now()
+	var keys []string
+	for i := 0; i < indexShards; i++ {
+		m, err := c.load(ctx, indexShardKey(i))
+		if err != nil {
+			return nil, err
+		}
+		for k, e := range m {
+			if (e.Expires.IsZero() || now.Before(e.Expires)) && match(k, e) {
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// update sets the index entry of key, or removes it if e is nil. The
+// update is left to the caller writing the shard of key, if any, which
+// writes it along with its own. Otherwise the shard is written with the
+// updates queued meanwhile.
+func (c *KeyIndex) update(ctx context.Context, key string, e *indexEntry) error {
+	shard := indexShard(key)
+	c.mu.Lock()
+	if c.pending == nil {
+		c.pending = make(map[string]map[string]*indexEntry)
+		c.flushing = make(map[string]bool)
+	}
+	if c.pending[shard] == nil {
+		c.pending[shard] = make(map[string]*indexEntry)
+	}
+	c.pending[shard][key] = e
+	if c.flushing[shard] {
+		c.mu.Unlock()
+		return nil
+	}
+	c.flushing[shard] = true
+	c.mu.Unlock()
+
+	for {
+		c.mu.Lock()
+		batch := c.pending[shard]
+		delete(c.pending, shard)
+		if len(batch) == 0 {
+			delete(c.flushing, shard)
+			c.mu.Unlock()
+			return nil
+		}
+		c.mu.Unlock()
+		if err := c.write(ctx, shard, batch); err != nil {
+			c.mu.Lock()
+			delete(c.flushing, shard)
+			c.mu.Unlock()
+			return err
+		}
+	}
+}
+
+// write applies the updates of batch to the index shard stored under
+// shard, pruning expired entries.
+func (c *KeyIndex) write(ctx context.Context, shard string, batch map[string]*indexEntry) error {
+	m, err := c.load(ctx, shard)
+	if err != nil {
+		return err
+	}
+	for k, e := range batch {
+		if e == nil {
+			delete(m, k)
+		} else {
+			m[k] = *e
+		}
+	}
+	now := time.Now()
+	for k, e := range m {
+		if !e.Expires.IsZero() && now.After(e.Expires) {
+			delete(m, k)
+		}
+	}
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(m); err != nil {
+		return err
+	}
+	return c.Cache.Set(ctx, shard, b.Bytes(), 0)
+}
+
+// load returns the index shard stored under shard, empty if missing.
+func (c *KeyIndex) load(ctx context.Context, shard string) (map[string]indexEntry, error) {
+	m := make(map[string]indexEntry)
+	v, err := c.Cache.Get(ctx, shard)
+	if err == ErrCacheMiss {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&m); err != nil {
+		// start over rather than failing every update
+		log.Printf("[ERROR] cache: corrupted key index %q: %v", shard, err)
+		return make(map[string]indexEntry), nil
+	}
+	return m, nil
+}
+
+// unindexed reports whether key is internal and kept out of the index,
+// such as the keys of fetch leases and of the index itself.
+func unindexed(key string) bool {
+	return strings.HasPrefix(key, indexKeyPrefix) || strings.HasSuffix(key, fetchLeaseSuffix)
+}
+
+// indexShard returns the key of the index shard of key.
+func indexShard(key string) string {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return indexShardKey(int(h.Sum32() % indexShards))
+}
+
+func indexShardKey(i int) string {
+	return fmt.Sprintf("%s%d", indexKeyPrefix, i)
+}
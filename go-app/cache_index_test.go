@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestKeyIndex(t *testing.T) {
+	ctx := context.Background()
+	c := &KeyIndex{Cache: NewLRUCache(1 << 20)}
+	c.SetTagged(ctx, "v/docs/a", []byte("a"), 0, []string{"docs"})
+	c.SetTagged(ctx, "v/docs/b", []byte("b"), time.Hour, []string{"docs", "ja"})
+	c.Set(ctx, "v/blog/c", []byte("c"), 0)
+	c.SetTagged(ctx, "v/docs/old", []byte("old"), time.Nanosecond, []string{"docs"})
+	time.Sleep(time.Millisecond)
+
+	keys, err := c.Keys(ctx, "v/docs/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"v/docs/a", "v/docs/b"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("Keys: got %v, want %v", keys, want)
+	}
+	keys, _ = c.Tagged(ctx, "ja")
+	if want := []string{"v/docs/b"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("Tagged: got %v, want %v", keys, want)
+	}
+
+	c.Delete(ctx, "v/docs/a")
+	keys, _ = c.Keys(ctx, "")
+	if want := []string{"v/blog/c", "v/docs/b"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("after delete: got %v, want %v", keys, want)
+	}
+	// retagging replaces the tags
+	c.SetTagged(ctx, "v/docs/b", []byte("b2"), 0, nil)
+	if keys, _ = c.Tagged(ctx, "ja"); len(keys) != 0 {
+		t.Errorf("after retag: got %v", keys)
+	}
+	if v, _ := c.Get(ctx, "v/docs/b"); string(v) != "b2" {
+		t.Errorf("got value %q", v)
+	}
+
+	c.Cache.Set(ctx, indexShard("v/blog/c"), []byte("garbage"), 0)
+	if err := c.Set(ctx, "v/blog/c", []byte("c"), 0); err != nil {
+		t.Errorf("corrupted index: %v", err)
+	}
+	if keys, _ = c.Keys(ctx, "v/blog/"); len(keys) != 1 {
+		t.Errorf("corrupted index: got %v", keys)
+	}
+}
+
+// shardWriteCache counts the writes of index shards to its Cache, blocking
+// them until release is closed when set.
+type shardWriteCache struct {
+	Cache
+	mu      sync.Mutex
+	writes  int
+	release chan struct{}
+	started chan struct{}
+}
+
+func (c *shardWriteCache) Set(ctx context.Context, key string, value []byte, expiry time.Duration) error {
+	if strings.HasPrefix(key, indexKeyPrefix) {
+		c.mu.Lock()
+		c.writes++
+		release, started := c.release, c.started
+		c.started = nil
+		c.mu.Unlock()
+		if started != nil {
+			close(started)
+		}
+		if release != nil {
+			<-release
+		}
+	}
+	return c.Cache.Set(ctx, key, value, expiry)
+}
+
+func TestKeyIndexBatch(t *testing.T) {
+	ctx := context.Background()
+	sc := &shardWriteCache{Cache: NewLRUCache(1 << 20), release: make(chan struct{}), started: make(chan struct{})}
+	c := &KeyIndex{Cache: sc}
+
+	// keys of a single shard
+	var keys []string
+	for i := 0; len(keys) < 10; i++ {
+		if k := fmt.Sprintf("v/docs/%d", i); indexShard(k) == indexShard("v/docs/0") {
+			keys = append(keys, k)
+		}
+	}
+	started, done := sc.started, make(chan struct{})
+	go func() {
+		c.Set(ctx, keys[0], []byte("a"), 0)
+		close(done)
+	}()
+	<-started
+	// updates don't wait for the shard being written
+	for _, k := range keys[1:] {
+		c.Set(ctx, k, []byte("a"), 0)
+	}
+	sc.mu.Lock()
+	close(sc.release)
+	sc.release = nil
+	sc.mu.Unlock()
+	<-done
+
+	if sc.writes != 2 {
+		t.Errorf("got %d shard writes, want 2", sc.writes)
+	}
+	got, err := c.Keys(ctx, "v/docs/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if !reflect.DeepEqual(got, keys) {
+		t.Errorf("got keys %v, want %v", got, keys)
+	}
+
+	// leases are not indexed
+	sc.writes = 0
+	if !acquireLease(ctx, c, "v/docs/x"+fetchLeaseSuffix, time.Second) {
+		t.Fatal("lease not acquired")
+	}
+	c.Delete(ctx, "v/docs/x"+fetchLeaseSuffix)
+	c.Set(ctx, "v/docs/y"+fetchLeaseSuffix, []byte{1}, time.Second)
+	if sc.writes != 0 {
+		t.Errorf("got %d shard writes for leases", sc.writes)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestLRUCache(t *testing.T) {
+	ctx := context.Background()
+	c := NewLRUCache(10)
+	if _, err := c.Get(ctx, "a"); err != ErrCacheMiss {
+		t.Fatalf("got %v, want ErrCacheMiss", err)
+	}
+	c.Set(ctx, "a", []byte("aaaa"), 0)
+	c.Set(ctx, "b", []byte("bbbb"), 0)
+	if v, err := c.Get(ctx, "a"); err != nil || string(v) != "aaaa" {
+		t.Fatalf("got %q, %v", v, err)
+	}
+	// "b" is the least recently used and is evicted
+	c.Set(ctx, "c", []byte("cccc"), 0)
+	if _, err := c.Get(ctx, "b"); err != ErrCacheMiss {
+		t.Errorf("b: got %v, want ErrCacheMiss", err)
+	}
+	for _, k := range []string{"a", "c"} {
+		if _, err := c.Get(ctx, k); err != nil {
+			t.Errorf("%s: %v", k, err)
+		}
+	}
+	// values larger than the cache are not stored
+	c.Set(ctx, "big", make([]byte, 11), 0)
+	if _, err := c.Get(ctx, "big"); err != ErrCacheMiss {
+		t.Errorf("big: got %v, want ErrCacheMiss", err)
+	}
+	c.Delete(ctx, "a")
+	if _, err := c.Get(ctx, "a"); err != ErrCacheMiss {
+		t.Errorf("a: got %v, want ErrCacheMiss", err)
+	}
+	c.Set(ctx, "d", []byte("d"), time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if _, err := c.Get(ctx, "d"); err != ErrCacheMiss {
+		t.Errorf("d: got %v, want ErrCacheMiss", err)
+	}
+	c.Flush(ctx)
+	if _, err := c.Get(ctx, "c"); err != ErrCacheMiss {
+		t.Errorf("c: got %v, want ErrCacheMiss", err)
+	}
+	if c.bytes != 0 {
+		t.Errorf("got %d bytes after flush", c.bytes)
+	}
+}
+
+func TestStorageCache(t *testing.T) {
+	ctx := context.Background()
+	s, mem := newTestStorage()
+	s.Cache = NewLRUCache(1 << 20)
+
+	o, err := s.Open(ctx, "goa.design", "docs/style.css")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(o.Body)
+	o.Body.Close()
+
+	// served from cache once the backend object is gone
+	mem.Delete("goa.design", "docs/style.css")
+	o, err = s.Open(ctx, "goa.design", "docs/style.css")
+	if err != nil {
+		t.Fatalf("expected cache hit: %v", err)
+	}
+	b, _ := io.ReadAll(o.Body)
+	if string(b) != "body{}" || o.Meta["content-type"] != "text/css" {
+		t.Errorf("got %q %v", b, o.Meta)
+	}
+
+	if err := s.PurgeCache(ctx, "goa.design", "docs/style.css"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Open(ctx, "goa.design", "docs/style.css"); err == nil {
+		t.Error("expected error after purge")
+	}
+}
+
+func TestNewCache(t *testing.T) {
+	if c, err := NewCache(""); err != nil {
+		t.Errorf("default: %v", err)
+	} else if ki, ok := c.(*KeyIndex); !ok {
+		t.Errorf("default: got %T, want *KeyIndex", c)
+	} else if _, ok := ki.Cache.(*LRUCache); !ok {
+		t.Errorf("default: got %T index, want *LRUCache", ki.Cache)
+	} else if sharedCache(c) {
+		t.Error("default: lru cache is shared")
+	}
+	if !sharedCache(&KeyIndex{Cache: &RedisCache{}}) {
+		t.Error("redis cache is not shared")
+	}
+	if c, err := NewCache("none"); err != nil || c != nil {
+		t.Errorf("none: got %v, %v", c, err)
+	}
+	for _, kind := range []string{"memcache", "bogus"} {
+		if _, err := NewCache(kind); err == nil {
+			t.Errorf("%s: expected error", kind)
+		}
+	}
+	t.Setenv("REDIS_ADDR", "")
+	if _, err := NewCache("redis"); err == nil {
+		t.Error("redis: expected error without REDIS_ADDR")
+	}
+}
+
+func TestChunkedCache(t *testing.T) {
+	ctx := context.Background()
+	lru := NewLRUCache(1 << 20)
+	c := &ChunkedCache{Cache: lru, ChunkSize: 10}
+
+	c.Set(ctx, "small", []byte("abc"), 0)
+	if v, err := c.Get(ctx, "small"); err != nil || string(v) != "abc" {
+		t.Errorf("small: got %q, %v", v, err)
+	}
+
+	big := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	c.Set(ctx, "big", big, 0)
+	if n := len(lru.items); n != 6 {
+		t.Errorf("got %d items, want small, manifest and 4 chunks", n)
+	}
+	if v, err := c.Get(ctx, "big"); err != nil || string(v) != string(big) {
+		t.Errorf("big: got %q, %v", v, err)
+	}
+
+	// corrupt a chunk
+	for k, el := range lru.items {
+		if k != "big" && k != "small" {
+			el.Value.(*lruEntry).value = []byte("xxxxxxxxxx")
+			break
+		}
+	}
+	if _, err := c.Get(ctx, "big"); err != ErrCacheMiss {
+		t.Errorf("corrupted: got %v, want ErrCacheMiss", err)
+	}
+	if n := len(lru.items); n != 1 {
+		t.Errorf("got %d items after corruption, want 1", n)
+	}
+
+	// evict a chunk
+	c.Set(ctx, "big", big, 0)
+	for k := range lru.items {
+		if k != "big" && k != "small" {
+			lru.Delete(ctx, k)
+			break
+		}
+	}
+	if _, err := c.Get(ctx, "big"); err != ErrCacheMiss {
+		t.Errorf("evicted: got %v, want ErrCacheMiss", err)
+	}
+
+	c.Set(ctx, "big", big, 0)
+	c.Delete(ctx, "big")
+	if n := len(lru.items); n != 1 {
+		t.Errorf("got %d items after delete, want 1", n)
+	}
+}
+
+// multiGetCache is a MultiGetter counting the reads of its Cache.
+type multiGetCache struct {
+	Cache
+	gets, multiGets int
+}
+
+func (c *multiGetCache) Get(ctx context.Context, key string) ([]byte, error) {
+	c.gets++
+	return c.Cache.Get(ctx, key)
+}
+
+func (c *multiGetCache) GetMulti(ctx context.Context, keys []string) (map[string][]byte, error) {
+	c.multiGets++
+	values := make(map[string][]byte)
+	for _, k := range keys {
+		if v, err := c.Cache.Get(ctx, k); err == nil {
+			values[k] = v
+		}
+	}
+	return values, nil
+}
+
+func TestChunkedCacheGetMulti(t *testing.T) {
+	ctx := context.Background()
+	mc := &multiGetCache{Cache: NewLRUCache(1 << 20)}
+	c := &ChunkedCache{Cache: mc, ChunkSize: 10}
+	big := bytes.Repeat([]byte("0123456789"), getMultiBatch+1)
+	c.Set(ctx, "big", big, 0)
+	if v, err := c.Get(ctx, "big"); err != nil || !bytes.Equal(v, big) {
+		t.Fatalf("got %q, %v", v, err)
+	}
+	// the manifest, then the chunks in two batches
+	if mc.gets != 1 || mc.multiGets != 2 {
+		t.Errorf("got %d gets and %d multi gets, want 1 and 2", mc.gets, mc.multiGets)
+	}
+}
+
+func TestCacheAdd(t *testing.T) {
+	ctx := context.Background()
+	for name, c := range map[string]Cache{
+		"lru":     NewLRUCache(1 << 10),
+		"chunked": &ChunkedCache{Cache: NewLRUCache(1 << 10), ChunkSize: 100},
+		"indexed": &KeyIndex{Cache: NewLRUCache(1 << 10)},
+	} {
+		a := c.(Adder)
+		if err := a.Add(ctx, "k", []byte("v1"), 0); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := a.Add(ctx, "k", []byte("v2"), 0); err != ErrNotStored {
+			t.Errorf("%s: got %v, want ErrNotStored", name, err)
+		}
+		if v, err := c.Get(ctx, "k"); err != nil || string(v) != "v1" {
+			t.Errorf("%s: got %q, %v", name, v, err)
+		}
+		// expired items are replaced
+		a.Add(ctx, "e", []byte("v1"), time.Nanosecond)
+		time.Sleep(time.Millisecond)
+		if err := a.Add(ctx, "e", []byte("v2"), 0); err != nil {
+			t.Errorf("%s: expired: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// CORS is a cross-origin resource sharing policy, see
+// https://fetch.spec.whatwg.org/#http-cors-protocol.
+type CORS struct {
+	// Origin lists the allowed origins. "*" allows any origin and a
+	// pattern such as "https://*.goa.design" allows any subdomain.
+	Origin []string `json:"origin"`
+	// Headers lists the request headers allowed in preflight requests.
+	Headers []string `json:"headers"`
+	// Expose lists the response headers exposed to scripts.
+	Expose []string `json:"expose"`
+	// Credentials allows requests with cookies or HTTP authentication
+	// from the origins of Origin, which must then be listed explicitly or
+	// as patterns since browsers forbid "*" for such requests. The request
+	// origin is echoed.
+	Credentials bool `json:"credentials"`
+	// MaxAge is the preflight cache duration, in seconds.
+	MaxAge string `json:"maxAge"`
+
+	// Paths overrides the policy for URL paths starting with the keys,
+	// e.g. "/proxy/". The longest matching prefix wins.
+	Paths map[string]*CORS `json:"paths"`
+}
+
+// LoadCORS reads a CORS policy from the JSON file at path.
+func LoadCORS(path string) (*CORS, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c CORS
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("decode CORS policy: %w", err)
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// validate reports malformed origin patterns and path prefixes, and
+// credentials allowed for any origin.
+func (c *CORS) validate() error {
+	for _, o := range c.Origin {
+		if o == "*" {
+			if c.Credentials {
+				return fmt.Errorf("CORS policy: credentials require explicit origins, not %q", o)
+			}
+			continue
+		}
+		if strings.Count(o, "*") > 1 || (strings.Contains(o, "*") && !strings.Contains(o, "://*.")) {
+			return fmt.Errorf("CORS policy: invalid origin pattern %q", o)
+		}
+	}
+	for p, pc := range c.Paths {
+		if !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("CORS policy: path %q must start with /", p)
+		}
+		if len(pc.Paths) > 0 {
+			return fmt.Errorf("CORS policy: path %q: nested paths", p)
+		}
+		if err := pc.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// policy returns the policy applying to the URL path p.
+func (c *CORS) policy(p string) *CORS {
+	best, n := c, -1
+	for prefix, pc := range c.Paths {
+		if strings.HasPrefix(p, prefix) && len(prefix) > n {
+			best, n = pc, len(prefix)
+		}
+	}
+	return best
+}
+
+// allowOrigin returns the value of the Access-Control-Allow-Origin header
+// for a request from origin, or "" if origin is not allowed.
+func (c *CORS) allowOrigin(origin string) string {
+	for _, o := range c.Origin {
+		if o == "*" && !c.Credentials {
+			return "*"
+		}
+		if origin != "" && originMatch(o, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// anyOrigin reports whether the responses don't depend on the request
+// origin.
+func (c *CORS) anyOrigin() bool {
+	for _, o := range c.Origin {
+		if o == "*" {
+			return !c.Credentials
+		}
+	}
+	return len(c.Origin) == 0
+}
+
+// originMatch reports whether origin matches pattern, either exactly or,
+// for a pattern such as "https://*.goa.design", as a subdomain.
+func originMatch(pattern, origin string) bool {
+	origin = strings.ToLower(origin)
+	pattern = strings.ToLower(pattern)
+	prefix, suffix, ok := strings.Cut(pattern, "*")
+	if !ok {
+		return pattern == origin
+	}
+	if len(origin) <= len(prefix)+len(suffix) || !strings.HasPrefix(origin, prefix) || !strings.HasSuffix(origin, suffix) {
+		return false
+	}
+	sub := origin[len(prefix) : len(origin)-len(suffix)]
+	return !strings.ContainsAny(sub, "/:@") && !strings.HasPrefix(sub, ".") && !strings.HasSuffix(sub, ".")
+}
+
+// isPreflight reports whether r is a CORS preflight request.
+func isPreflight(r *http.Request) bool {
+	return r.Method == "OPTIONS" && r.Header.Get("origin") != "" &&
+		r.Header.Get("access-control-request-method") != ""
+}
+
+// serveCORS sets the CORS headers of the response to r according to the
+// policy for the request path. It answers preflight requests with
+// 204 No Content and reports whether it did so, in which case the caller
+// must not write anything else.
+func (c *CORS) serveCORS(w http.ResponseWriter, r *http.Request) bool {
+	c = c.policy(r.URL.Path)
+	h := w.Header()
+	if !c.anyOrigin() {
+		addVary(h, "Origin")
+	}
+	origin := r.Header.Get("origin")
+	allow := c.allowOrigin(origin)
+	if !isPreflight(r) {
+		if allow != "" {
+			h.Set("access-control-allow-origin", allow)
+			if c.Credentials {
+				h.Set("access-control-allow-credentials", "true")
+			}
+			if len(c.Expose) > 0 {
+				h.Set("access-control-expose-headers", strings.Join(c.Expose, ", "))
+			}
+		}
+		return false
+	}
+
+	// a preflight response without CORS headers makes the browser fail
+	// the actual request
+	h.Del("content-type")
+	if allow != "" && ValidMethod(r.Header.Get("access-control-request-method")) {
+		if headers, ok := c.allowHeaders(r.Header.Get("access-control-request-headers")); ok {
+			h.Set("access-control-allow-origin", allow)
+			h.Set("access-control-allow-methods", allowMethods)
+			if headers != "" {
+				h.Set("access-control-allow-headers", headers)
+			}
+			if c.Credentials {
+				h.Set("access-control-allow-credentials", "true")
+			}
+			if c.MaxAge != "" {
+				h.Set("access-control-max-age", c.MaxAge)
+			}
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// allowHeaders returns the value of the Access-Control-Allow-Headers
+// header for the comma-separated list of requested headers, and false if
+// any of them is not allowed.
+func (c *CORS) allowHeaders(requested string) (string, bool) {
+	var allowed []string
+	for _, name := range strings.Split(requested, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		ok := false
+		for _, a := range c.Headers {
+			if a == "*" && !c.Credentials || strings.EqualFold(a, name) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return "", false
+		}
+		allowed = append(allowed, name)
+	}
+	return strings.Join(allowed, ", "), true
+}
+
+// addVary adds name to the Vary header of h unless already listed.
+func addVary(h http.Header, name string) {
+	var names []string
+	for _, v := range h.Values("vary") {
+		for _, n := range strings.Split(v, ",") {
+			n = strings.TrimSpace(n)
+			if strings.EqualFold(n, name) || n == "*" {
+				return
+			}
+			if n != "" {
+				names = append(names, n)
+			}
+		}
+	}
+	h.Set("vary", strings.Join(append(names, name), ", "))
+}
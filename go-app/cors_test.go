@@ -0,0 +1,226 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOriginMatch(t *testing.T) {
+	cases := []struct {
+		pattern, origin string
+		want            bool
+	}{
+		{"https://goa.design", "https://goa.design", true},
+		{"https://goa.design", "https://GOA.design", true},
+		{"https://goa.design", "http://goa.design", false},
+		{"https://*.goa.design", "https://www.goa.design", true},
+		{"https://*.goa.design", "https://a.b.goa.design", true},
+		{"https://*.goa.design", "https://goa.design", false},
+		{"https://*.goa.design", "https://.goa.design", false},
+		{"https://*.goa.design", "https://evilgoa.design", false},
+		{"https://*.goa.design", "https://goa.design.evil.com", false},
+		{"https://*.goa.design", "https://evil.com/.goa.design", false},
+		{"https://*.goa.design", "http://www.goa.design", false},
+	}
+	for _, c := range cases {
+		if got := originMatch(c.pattern, c.origin); got != c.want {
+			t.Errorf("originMatch(%q, %q) = %v, want %v", c.pattern, c.origin, got, c.want)
+		}
+	}
+}
+
+func TestCORSOrigins(t *testing.T) {
+	// origins need not be sorted
+	cors := &CORS{Origin: []string{"https://c.example.com", "https://a.example.com", "https://*.goa.design"}}
+	cases := map[string]string{
+		"":                        "",
+		"https://a.example.com":   "https://a.example.com",
+		"https://c.example.com":   "https://c.example.com",
+		"https://d.example.com":   "",
+		"https://docs.goa.design": "https://docs.goa.design",
+	}
+	for origin, want := range cases {
+		if got := cors.allowOrigin(origin); got != want {
+			t.Errorf("allowOrigin(%q) = %q, want %q", origin, got, want)
+		}
+	}
+
+	// the wildcard never allows credentialed requests, even if the policy
+	// skipped validation
+	cors = &CORS{Origin: []string{"*"}, Credentials: true}
+	if err := cors.validate(); err == nil {
+		t.Error("wildcard with credentials: expected error")
+	}
+	if got := cors.allowOrigin("https://evil.example"); got != "" {
+		t.Errorf("wildcard with credentials: got allow-origin %q", got)
+	}
+}
+
+func TestServeCORS(t *testing.T) {
+	cors := &CORS{
+		Origin:  []string{"https://*.goa.design"},
+		Headers: []string{"Range", "If-None-Match"},
+		Expose:  []string{"Etag"},
+		MaxAge:  "600",
+		Paths: map[string]*CORS{
+			"/proxy/":      {Origin: []string{"*"}},
+			"/proxy/auth/": {Origin: []string{"https://*.goa.design"}, Credentials: true, Headers: []string{"*"}},
+		},
+	}
+	cases := []struct {
+		name      string
+		method    string
+		path      string
+		headers   map[string]string
+		preflight bool
+		want      map[string]string
+	}{
+		{"allowed origin", "GET", "/docs/", map[string]string{"origin": "https://www.goa.design"}, false, map[string]string{
+			"access-control-allow-origin":   "https://www.goa.design",
+			"access-control-expose-headers": "Etag",
+			"vary":                          "Origin",
+		}},
+		{"disallowed origin", "GET", "/docs/", map[string]string{"origin": "https://evil.com"}, false, map[string]string{
+			"access-control-allow-origin": "",
+			"vary":                        "Origin",
+		}},
+		{"no origin", "GET", "/docs/", nil, false, map[string]string{
+			"access-control-allow-origin": "",
+			"vary":                        "Origin",
+		}},
+		{"preflight", "OPTIONS", "/docs/", map[string]string{
+			"origin":                         "https://www.goa.design",
+			"access-control-request-method":  "GET",
+			"access-control-request-headers": "range, if-none-match",
+		}, true, map[string]string{
+			"access-control-allow-origin":  "https://www.goa.design",
+			"access-control-allow-methods": allowMethods,
+			"access-control-allow-headers": "range, if-none-match",
+			"access-control-max-age":       "600",
+		}},
+		{"preflight header not allowed", "OPTIONS", "/docs/", map[string]string{
+			"origin":                         "https://www.goa.design",
+			"access-control-request-method":  "GET",
+			"access-control-request-headers": "x-custom",
+		}, true, map[string]string{
+			"access-control-allow-origin":  "",
+			"access-control-allow-headers": "",
+		}},
+		{"preflight method not allowed", "OPTIONS", "/docs/", map[string]string{
+			"origin":                        "https://www.goa.design",
+			"access-control-request-method": "DELETE",
+		}, true, map[string]string{
+			"access-control-allow-origin": "",
+		}},
+		{"preflight origin not allowed", "OPTIONS", "/docs/", map[string]string{
+			"origin":                        "https://evil.com",
+			"access-control-request-method": "GET",
+		}, true, map[string]string{
+			"access-control-allow-origin": "",
+		}},
+		{"options without preflight", "OPTIONS", "/docs/", map[string]string{"origin": "https://www.goa.design"}, false, map[string]string{
+			"access-control-allow-origin":  "https://www.goa.design",
+			"access-control-allow-methods": "",
+		}},
+		{"path policy", "GET", "/proxy/goa.design/clue/@v/list", map[string]string{"origin": "https://evil.com"}, false, map[string]string{
+			"access-control-allow-origin":   "*",
+			"access-control-expose-headers": "",
+			"vary":                          "",
+		}},
+		{"credentials", "GET", "/proxy/auth/x", map[string]string{"origin": "https://www.goa.design"}, false, map[string]string{
+			"access-control-allow-origin":      "https://www.goa.design",
+			"access-control-allow-credentials": "true",
+			"vary":                             "Origin",
+		}},
+		{"credentials origin not allowed", "GET", "/proxy/auth/x", map[string]string{"origin": "https://evil.com"}, false, map[string]string{
+			"access-control-allow-origin":      "",
+			"access-control-allow-credentials": "",
+		}},
+		{"credentials preflight", "OPTIONS", "/proxy/auth/x", map[string]string{
+			"origin":                         "https://www.goa.design",
+			"access-control-request-method":  "GET",
+			"access-control-request-headers": "authorization",
+		}, true, map[string]string{
+			// the header wildcard doesn't apply to credentialed requests
+			"access-control-allow-origin": "",
+		}},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, c.path, nil)
+		for k, v := range c.headers {
+			r.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		if got := cors.serveCORS(rec, r); got != c.preflight {
+			t.Errorf("%s: got preflight %v, want %v", c.name, got, c.preflight)
+		}
+		if c.preflight && rec.Code != 204 {
+			t.Errorf("%s: got status %d, want 204", c.name, rec.Code)
+		}
+		for k, v := range c.want {
+			if got := rec.Header().Get(k); got != v {
+				t.Errorf("%s: got %s %q, want %q", c.name, k, got, v)
+			}
+		}
+	}
+}
+
+func TestServeObjectPreflight(t *testing.T) {
+	s, _ := newTestStorage()
+	s.CORS.Origin = []string{"https://goa.design"}
+	s.CORS.Headers = []string{"Range"}
+	o, err := s.OpenFile(t.Context(), "goa.design", "docs/style.css")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Body.Close()
+	o.Meta["vary"] = "Accept-Encoding"
+	r := httptest.NewRequest("OPTIONS", "/docs/style.css", nil)
+	r.Header.Set("origin", "https://goa.design")
+	r.Header.Set("access-control-request-method", "GET")
+	r.Header.Set("access-control-request-headers", "Range")
+	rec := httptest.NewRecorder()
+	if err := s.ServeObject(rec, r, o); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != 204 || rec.Body.Len() != 0 {
+		t.Errorf("got status %d and body %q, want 204 and no body", rec.Code, rec.Body.String())
+	}
+	if v := rec.Header().Get("vary"); v != "Accept-Encoding, Origin" {
+		t.Errorf("got vary %q", v)
+	}
+	if v := rec.Header().Get("access-control-allow-headers"); v != "Range" {
+		t.Errorf("got allow-headers %q", v)
+	}
+}
+
+func TestLoadCORS(t *testing.T) {
+	dir := t.TempDir()
+	cases := map[string]bool{
+		`{"origin": ["*"], "maxAge": "60"}`:                                             true,
+		`{"origin": ["https://*.goa.design"], "paths": {"/proxy/": {"origin": ["*"]}}}`: true,
+		`{"origin": ["https://goa.*"]}`:                                                 false,
+		`{"origin": ["*.goa.design"]}`:                                                  false,
+		`{"paths": {"proxy/": {"origin": ["*"]}}}`:                                      false,
+		`{"paths": {"/a/": {"paths": {"/a/b/": {}}}}}`:                                  false,
+		`{"origin": "*"}`:                                                               false,
+		`{"origin": ["*"], "credentials": true}`:                                        false,
+		`{"paths": {"/auth/": {"origin": ["*"], "credentials": true}}}`:                 false,
+		`{"origin": ["https://*.goa.design"], "credentials": true}`:                     true,
+	}
+	for cfg, ok := range cases {
+		p := filepath.Join(dir, "cors.json")
+		if err := os.WriteFile(p, []byte(cfg), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := LoadCORS(p)
+		if ok && err != nil {
+			t.Errorf("%s: %v", cfg, err)
+		}
+		if !ok && err == nil {
+			t.Errorf("%s: expected error", cfg)
+		}
+	}
+}
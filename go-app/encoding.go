@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressMinSize is the size under which objects are served as is,
+// compression overhead outweighing the savings.
+const compressMinSize = 1 << 10
+
+// noSiblingSuffix is appended to the cache key of an encoded variant to
+// remember that the object has no usable pre-compressed sibling, when the
+// object is too large to be compressed on the fly.
+const noSiblingSuffix = "#nosibling"
+
+// encodings lists the supported content codings in order of preference,
+// with the extension of pre-compressed sibling objects.
+var encodings = []struct {
+	name, ext string
+}{
+	{"br", ".br"},
+	{"zstd", ".zst"},
+	{"gzip", ".gz"},
+}
+
+// compressible reports whether objects of the given content type benefit
+// from compression.
+func compressible(ctype string) bool {
+	mt, _, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mt, "text/") || strings.HasSuffix(mt, "+json") || strings.HasSuffix(mt, "+xml") {
+		return true
+	}
+	switch mt {
+	case "application/javascript", "application/json", "application/xml",
+		"application/wasm", "application/vnd.ms-fontobject", "font/ttf", "font/otf":
+		return true
+	}
+	return false
+}
+
+// negotiateEncoding returns the preferred content coding of the Accept-Encoding
+// header value ae among the supported encodings, or "" for identity.
+// See RFC 9110, section 12.5.3.
+func negotiateEncoding(ae string) string {
+	q := make(map[string]float64)
+	for _, part := range strings.Split(ae, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		v, ok := qvalue(params)
+		if !ok {
+			continue
+		}
+		q[name] = v
+	}
+	best, bestQ := "", 0.0
+	for _, e := range encodings {
+		v, ok := q[e.name]
+		if !ok {
+			v, ok = q["*"]
+		}
+		if ok && v > bestQ {
+			best, bestQ = e.name, v
+		}
+	}
+	return best
+}
+
+// qvalue returns the weight of the parameters params of an element of
+// an Accept* header, 1 by default, and whether it is valid.
+func qvalue(params string) (float64, bool) {
+	for _, p := range strings.Split(params, ";") {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(p), "q="); ok {
+			f, err := strconv.ParseFloat(v, 64)
+			return f, err == nil
+		}
+	}
+	return 1, true
+}
+
+// encodeObject returns the variant of o encoded with the content coding
+// negotiated for r, or o itself if o is not worth encoding or the client
+// accepts no supported coding. Variants are read from pre-compressed
+// sibling objects in the bucket, e.g. "app.js.br", or compressed on the
+// fly, and cached alongside the identity object.
+func (s *Storage) encodeObject(ctx context.Context, r *http.Request, bucket string, o *Object) *Object {
+	if o.Redirect() != "" || o.Meta["content-range"] != "" || o.Meta["content-encoding"] != "" {
+		return o
+	}
+	if !compressible(o.Meta["content-type"]) {
+		return o
+	}
+	// caches must not serve a variant to clients that don't accept it
+	o.Meta["vary"] = "Accept-Encoding"
+	if (o.Size >= 0 && o.Size < compressMinSize) || r.Header.Get("range") != "" {
+		return o
+	}
+	enc := negotiateEncoding(r.Header.Get("accept-encoding"))
+	if enc == "" {
+		return o
+	}
+
+	key, etag := "", o.Meta["etag"]
+	if s.Cache != nil && etag != "" {
+		key = s.CacheKey(ctx, bucket, o.Name) + ";" + enc
+		if b, err := getCache(ctx, s.Cache, key); err == nil && b.Source == etag {
+			o.Body.Close()
+			eo := b.object()
+			eo.Name = o.Name
+			return eo
+		}
+	}
+
+	// too big to hold in memory
+	large := o.Size < 0 || o.Size >= cacheObjectMax
+	if large && key != "" {
+		if v, err := s.Cache.Get(ctx, key+noSiblingSuffix); err == nil && string(v) == etag {
+			return o
+		}
+	}
+	body, err := s.siblingBody(ctx, bucket, o.Name, enc)
+	if err != nil {
+		if large {
+			if key != "" {
+				s.Cache.Set(ctx, key+noSiblingSuffix, []byte(etag), s.cacheExpiry())
+			}
+			return o
+		}
+		identity, err := io.ReadAll(o.Body)
+		o.Body.Close()
+		if err != nil {
+			log.Printf("[ERROR] read %s/%s: %v", bucket, o.Name, err)
+			o.Body = newBytesBody(identity)
+			return o
+		}
+		o.Body = newBytesBody(identity)
+		if body, err = compress(identity, enc); err != nil {
+			log.Printf("[ERROR] %s %s/%s: %v", enc, bucket, o.Name, err)
+			return o
+		}
+	} else {
+		o.Body.Close()
+	}
+
+	meta := make(map[string]string, len(o.Meta)+1)
+	for k, v := range o.Meta {
+		meta[k] = v
+	}
+	meta["content-encoding"] = enc
+	if etag != "" {
+		// each representation has its own entity tag
+		meta["etag"] = strings.TrimSuffix(etag, `"`) + "-" + enc + `"`
+	}
+	if key != "" {
+		setCache(ctx, s.Cache, &objectBuf{Meta: meta, Body: body, Fetched: time.Now(), Source: etag, key: key})
+	}
+	return &Object{Name: o.Name, Meta: meta, Body: newBytesBody(body), Size: int64(len(body))}
+}
+
+// siblingBody reads the pre-compressed sibling of object name encoded with
+// enc, e.g. "app.js.br" for "app.js" and "br". Siblings too large to be
+// cached are reported as errors.
+func (s *Storage) siblingBody(ctx context.Context, bucket, name, enc string) ([]byte, error) {
+	var ext string
+	for _, e := range encodings {
+		if e.name == enc {
+			ext = e.ext
+		}
+	}
+	if ext == "" || path.Ext(name) == ext {
+		return nil, &FetchError{Msg: name + ": no sibling", Code: http.StatusNotFound}
+	}
+	o, err := s.Backend.Open(ctx, bucket, name+ext)
+	if err != nil {
+		return nil, err
+	}
+	defer o.Body.Close()
+	if o.Size >= cacheObjectMax {
+		return nil, fmt.Errorf("%s: sibling too large", name+ext)
+	}
+	b, err := io.ReadAll(io.LimitReader(o.Body, cacheObjectMax))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) >= cacheObjectMax {
+		// truncated
+		return nil, fmt.Errorf("%s: sibling too large", name+ext)
+	}
+	return b, nil
+}
+
+// compress encodes b with the content coding enc.
+func compress(b []byte, enc string) ([]byte, error) {
+	var (
+		buf bytes.Buffer
+		w   io.WriteCloser
+		err error
+	)
+	switch enc {
+	case "br":
+		w = brotli.NewWriterLevel(&buf, brotli.DefaultCompression)
+	case "zstd":
+		w, err = zstd.NewWriter(&buf)
+	case "gzip":
+		w, err = gzip.NewWriterLevel(&buf, gzip.DefaultCompression)
+	default:
+		return nil, &FetchError{Msg: "unsupported encoding " + enc, Code: http.StatusNotAcceptable}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	cases := map[string]string{
+		"":                         "",
+		"identity":                 "",
+		"gzip":                     "gzip",
+		"gzip, deflate, br":        "br",
+		"gzip, deflate, br, zstd":  "br",
+		"gzip;q=1.0, br;q=0.5":     "gzip",
+		"br;q=0, gzip":             "gzip",
+		"*":                        "br",
+		"*;q=0.5, br;q=0":          "zstd",
+		"GZIP":                     "gzip",
+		"gzip;q=bogus, zstd;q=0.1": "zstd",
+	}
+	for ae, want := range cases {
+		if got := negotiateEncoding(ae); got != want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", ae, got, want)
+		}
+	}
+}
+
+func TestCompressible(t *testing.T) {
+	cases := map[string]bool{
+		"text/html; charset=utf-8": true,
+		"text/css":                 true,
+		"application/javascript":   true,
+		"image/svg+xml":            true,
+		"application/json":         true,
+		"image/png":                false,
+		"application/zip":          false,
+		"":                         false,
+	}
+	for ctype, want := range cases {
+		if got := compressible(ctype); got != want {
+			t.Errorf("compressible(%q) = %v, want %v", ctype, got, want)
+		}
+	}
+}
+
+func decompress(t *testing.T, enc string, b []byte) string {
+	t.Helper()
+	var r io.Reader
+	switch enc {
+	case "br":
+		r = brotli.NewReader(bytes.NewReader(b))
+	case "zstd":
+		d, err := zstd.NewReader(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+		r = d
+	case "gzip":
+		g, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = g
+	default:
+		return string(b)
+	}
+	d, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("%s: %v", enc, err)
+	}
+	return string(d)
+}
+
+func TestEncodeObject(t *testing.T) {
+	page := strings.Repeat("<p>goa</p>\n", 200)
+	s, mem := newTestStorage()
+	s.Cache = NewLRUCache(1 << 20)
+	mem.Put("goa.design", "page.html", map[string]string{"content-type": "text/html", "etag": `"p1"`}, []byte(page))
+	mem.Put("goa.design", "logo.png", map[string]string{"content-type": "image/png"}, []byte(page))
+	cases := []struct {
+		name, ae, rng string
+		enc, etag     string
+		vary          bool
+	}{
+		{"page.html", "gzip", "", "gzip", `"p1-gzip"`, true},
+		{"page.html", "br, gzip", "", "br", `"p1-br"`, true},
+		{"page.html", "zstd", "", "zstd", `"p1-zstd"`, true},
+		{"page.html", "", "", "", `"p1"`, true},
+		{"page.html", "gzip", "bytes=0-1", "", `"p1"`, true},
+		{"docs/style.css", "gzip", "", "", "", true}, // too small
+		{"logo.png", "gzip", "", "", "", false},
+	}
+	for i := 0; i < 2; i++ { // second pass is served from the cache
+		for _, c := range cases {
+			o, err := s.OpenFile(context.Background(), "goa.design", c.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("GET", "/"+c.name, nil)
+			if c.ae != "" {
+				r.Header.Set("accept-encoding", c.ae)
+			}
+			if c.rng != "" {
+				r.Header.Set("range", c.rng)
+			}
+			o = s.encodeObject(context.Background(), r, "goa.design", o)
+			rec := httptest.NewRecorder()
+			if err := s.ServeObject(rec, r, o); err != nil {
+				t.Fatal(err)
+			}
+			o.Body.Close()
+			h := rec.Header()
+			if enc := h.Get("content-encoding"); enc != c.enc {
+				t.Errorf("%s %q: got encoding %q, want %q", c.name, c.ae, enc, c.enc)
+			}
+			if c.etag != "" && h.Get("etag") != c.etag {
+				t.Errorf("%s %q: got etag %s, want %s", c.name, c.ae, h.Get("etag"), c.etag)
+			}
+			if vary := h.Get("vary") == "Accept-Encoding"; vary != c.vary {
+				t.Errorf("%s %q: got vary %q", c.name, c.ae, h.Get("vary"))
+			}
+			if c.rng != "" {
+				continue
+			}
+			b := rec.Body.Bytes()
+			if c.enc != "" && h.Get("content-length") != "" && h.Get("content-length") != strconv.Itoa(len(b)) {
+				t.Errorf("%s %q: got content-length %s for %d bytes", c.name, c.ae, h.Get("content-length"), len(b))
+			}
+			o, _ = s.OpenFile(context.Background(), "goa.design", c.name)
+			want, _ := io.ReadAll(o.Body)
+			o.Body.Close()
+			if got := decompress(t, c.enc, b); got != string(want) {
+				t.Errorf("%s %q: decoded body mismatch", c.name, c.ae)
+			}
+		}
+	}
+}
+
+func TestEncodeObjectSibling(t *testing.T) {
+	page := strings.Repeat("console.log('goa');\n", 100)
+	s, mem := newTestStorage()
+	mem.Put("goa.design", "app.js", map[string]string{"content-type": "application/javascript"}, []byte(page))
+	// the sibling is served as is, the app relies on the build having
+	// compressed it
+	pre, err := compress([]byte(page), "gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem.Put("goa.design", "app.js.gz", map[string]string{"content-type": "application/gzip"}, pre)
+
+	o, err := s.OpenFile(context.Background(), "goa.design", "app.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/app.js", nil)
+	r.Header.Set("accept-encoding", "gzip")
+	o = s.encodeObject(context.Background(), r, "goa.design", o)
+	defer o.Body.Close()
+	if o.Meta["content-encoding"] != "gzip" {
+		t.Fatalf("got encoding %q, want gzip", o.Meta["content-encoding"])
+	}
+	if o.Meta["content-type"] != "application/javascript" {
+		t.Errorf("got content-type %q", o.Meta["content-type"])
+	}
+	b, _ := io.ReadAll(o.Body)
+	if !bytes.Equal(b, pre) {
+		t.Errorf("sibling body not served")
+	}
+}
+
+func TestEncodeObjectLargeSibling(t *testing.T) {
+	ctx := context.Background()
+	page := strings.Repeat("console.log('goa');\n", 100)
+	s, mem := newTestStorage()
+	mem.Put("goa.design", "app.js", map[string]string{"content-type": "application/javascript"}, []byte(page))
+	// not cached in full, and not served truncated
+	mem.Put("goa.design", "app.js.gz", nil, make([]byte, cacheObjectMax))
+
+	o, err := s.OpenFile(ctx, "goa.design", "app.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/app.js", nil)
+	r.Header.Set("accept-encoding", "gzip")
+	o = s.encodeObject(ctx, r, "goa.design", o)
+	defer o.Body.Close()
+	b, _ := io.ReadAll(o.Body)
+	if o.Meta["content-encoding"] != "gzip" || decompress(t, "gzip", b) != page {
+		t.Errorf("got %d bytes encoded with %q, want the object compressed on the fly", len(b), o.Meta["content-encoding"])
+	}
+}
+
+func TestEncodeObjectNoSibling(t *testing.T) {
+	ctx := context.Background()
+	s, mem := newTestStorage()
+	backend := &countingBackend{MemBackend: mem}
+	s.Backend = backend
+	s.Cache = NewLRUCache(1 << 20)
+	mem.Put("goa.design", "big.css", map[string]string{"content-type": "text/css"}, bytes.Repeat([]byte("p{}"), cacheObjectMax/3+1))
+
+	for i := 0; i < 3; i++ {
+		o, err := s.OpenFile(ctx, "goa.design", "big.css")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("GET", "/big.css", nil)
+		r.Header.Set("accept-encoding", "gzip")
+		o = s.encodeObject(ctx, r, "goa.design", o)
+		o.Body.Close()
+		if o.Meta["content-encoding"] != "" {
+			t.Errorf("got encoding %q, want identity", o.Meta["content-encoding"])
+		}
+	}
+	// the object itself, then the sibling once
+	if backend.opens != 4 {
+		t.Errorf("got %d backend requests, want 4", backend.opens)
+	}
+}
+
+func TestEncodeObjectNotModified(t *testing.T) {
+	s, mem := newTestStorage()
+	mem.Put("goa.design", "page.html", map[string]string{"content-type": "text/html", "etag": `"p1"`},
+		[]byte(strings.Repeat("goa ", 1000)))
+	o, err := s.OpenFile(context.Background(), "goa.design", "page.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/page.html", nil)
+	r.Header.Set("accept-encoding", "br")
+	r.Header.Set("if-none-match", `"p1-br"`)
+	o = s.encodeObject(context.Background(), r, "goa.design", o)
+	rec := httptest.NewRecorder()
+	if err := s.ServeObject(rec, r, o); err != nil {
+		t.Fatal(err)
+	}
+	o.Body.Close()
+	if rec.Code != 304 {
+		t.Errorf("got status %d, want 304", rec.Code)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// translations lists the languages the site is translated to, served
+// under /<lang>/. English is served at the root.
+var translations = []string{"es", "fr", "it", "ja"}
+
+// pathLanguage returns the translation the page at URL path p belongs to,
+// or "" for English.
+func pathLanguage(p string) string {
+	for _, l := range translations {
+		if p == "/"+l || strings.HasPrefix(p, "/"+l+"/") {
+			return l
+		}
+	}
+	return ""
+}
+
+// problem is a problem details document, see RFC 9457.
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+}
+
+// wantsJSON reports whether the Accept header value accept prefers JSON
+// over HTML, e.g. for API clients.
+func wantsJSON(accept string) bool {
+	var jsonQ, htmlQ, anyQ float64
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, _ := strings.Cut(part, ";")
+		q, ok := qvalue(params)
+		if !ok {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(mt)) {
+		case "application/json", "application/problem+json":
+			jsonQ = max(jsonQ, q)
+		case "text/html":
+			htmlQ = max(htmlQ, q)
+		case "text/*", "*/*":
+			anyQ = max(anyQ, q)
+		}
+	}
+	// explicit types take precedence over wildcards of the same weight
+	return jsonQ > 0 && jsonQ > htmlQ && jsonQ >= anyQ
+}
+
+// errorPage is the page of server errors, which can't be read from
+// storage when the storage fails.
+var errorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>{{.Title}} - Goa</title>
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+</head>
+<body>
+  <h1>{{.Title}}</h1>
+  <p>Something went wrong on our side. Please try again in a few moments.</p>
+  <p><a href="/">goa.design</a></p>
+</body>
+</html>
+`))
+
+// serveError responds to r with the error err returned when opening the
+// object of r from the bucket: a problem document for clients preferring
+// JSON, the 404.html object of the bucket for missing objects, localized
+// for translated pages, and errorPage for server errors.
+func (s *Storage) serveError(ctx context.Context, w http.ResponseWriter, r *http.Request, bucket string, err error) {
+	code := http.StatusInternalServerError
+	if isNotFound(err) {
+		code = http.StatusNotFound
+	} else if ferr, ok := err.(*FetchError); ok {
+		code = ferr.Code
+	}
+	h := w.Header()
+	addVary(h, "Accept")
+	if code >= 500 {
+		h.Set("cache-control", "no-store")
+	}
+
+	if wantsJSON(r.Header.Get("accept")) {
+		p := problem{
+			Type:     "about:blank",
+			Title:    http.StatusText(code),
+			Status:   code,
+			Instance: r.URL.Path,
+		}
+		if code == http.StatusNotFound {
+			p.Detail = fmt.Sprintf("%s was not found", r.URL.Path)
+		}
+		h.Set("content-type", "application/problem+json")
+		w.WriteHeader(code)
+		if r.Method != "HEAD" {
+			json.NewEncoder(w).Encode(p)
+		}
+		return
+	}
+
+	if code >= 500 {
+		h.Set("content-type", "text/html; charset=utf-8")
+		w.WriteHeader(code)
+		if r.Method != "HEAD" {
+			errorPage.Execute(w, struct{ Title string }{http.StatusText(code)})
+		}
+		return
+	}
+	if code == http.StatusNotFound {
+		if o := s.notFoundPage(ctx, bucket, pathLanguage(r.URL.Path)); o != nil {
+			defer o.Body.Close()
+			ctype := o.Meta["content-type"]
+			if ctype == "" {
+				ctype = "text/html; charset=utf-8"
+			}
+			h.Set("content-type", ctype)
+			w.WriteHeader(code)
+			if r.Method != "HEAD" {
+				io.Copy(w, o.Body)
+			}
+			return
+		}
+	}
+	http.Error(w, http.StatusText(code), code)
+}
+
+// notFoundPage returns the 404.html object of the bucket for the language
+// lang, falling back to the English one, or nil if there is none.
+func (s *Storage) notFoundPage(ctx context.Context, bucket, lang string) *Object {
+	names := []string{"404.html"}
+	if lang != "" {
+		names = append([]string{lang + "/404.html"}, names...)
+	}
+	for _, name := range names {
+		o, err := s.Open(ctx, bucket, name)
+		if err == nil {
+			return o
+		}
+		if !isNotFound(err) {
+			log.Printf("[ERROR] %s/%s: %v", bucket, name, err)
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWantsJSON(t *testing.T) {
+	cases := map[string]bool{
+		"":                         false,
+		"*/*":                      false,
+		"application/json":         true,
+		"application/problem+json": true,
+		"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8": false,
+		"application/json, text/plain, */*":                               true,
+		"text/html;q=0.5, application/json":                               true,
+		"application/json;q=0.5, text/html":                               false,
+	}
+	for accept, want := range cases {
+		if got := wantsJSON(accept); got != want {
+			t.Errorf("%q: got %v, want %v", accept, got, want)
+		}
+	}
+}
+
+func TestServeError(t *testing.T) {
+	s, mem := newTestStorage()
+	mem.Put("goa.design", "404.html", map[string]string{"content-type": "text/html"}, []byte("not found"))
+	mem.Put("goa.design", "ja/404.html", map[string]string{"content-type": "text/html"}, []byte("見つかりません"))
+	backend := &flakyBackend{countingBackend: &countingBackend{MemBackend: mem}}
+	s.Backend = backend
+
+	cases := []struct {
+		method, path, accept string
+		fail                 bool
+		code                 int
+		ctype                string
+		body                 string
+	}{
+		{"GET", "/docs/missing", "", false, 404, "text/html", "not found"},
+		{"GET", "/ja/docs/missing", "", false, 404, "text/html", "見つかりません"},
+		{"GET", "/fr/docs/missing", "", false, 404, "text/html", "not found"},
+		{"GET", "/japan/missing", "", false, 404, "text/html", "not found"},
+		{"HEAD", "/docs/missing", "", false, 404, "text/html", ""},
+		{"GET", "/docs/missing", "application/json", false, 404, "application/problem+json", `"status":404`},
+		{"GET", "/docs/style.css", "text/html", true, 503, "text/html; charset=utf-8", "Service Unavailable"},
+		{"GET", "/docs/style.css", "application/json", true, 503, "application/problem+json", `"title":"Service Unavailable"`},
+	}
+	for _, c := range cases {
+		backend.err = nil
+		if c.fail {
+			backend.err = &FetchError{Msg: "unavailable", Code: 503}
+		}
+		r := httptest.NewRequest(c.method, c.path, nil)
+		if c.accept != "" {
+			r.Header.Set("accept", c.accept)
+		}
+		rec := httptest.NewRecorder()
+		serveAsset(s)(rec, r)
+		if rec.Code != c.code {
+			t.Errorf("%s %s: got status %d, want %d", c.method, c.path, rec.Code, c.code)
+		}
+		if ct := rec.Header().Get("content-type"); ct != c.ctype {
+			t.Errorf("%s %s: got content-type %q, want %q", c.method, c.path, ct, c.ctype)
+		}
+		if b := rec.Body.String(); !strings.Contains(b, c.body) || c.body == "" && b != "" {
+			t.Errorf("%s %s: got body %q, want %q", c.method, c.path, b, c.body)
+		}
+		if v := rec.Header().Get("vary"); v != "Accept" {
+			t.Errorf("%s %s: got vary %q", c.method, c.path, v)
+		}
+	}
+
+	backend.err = nil
+
+	// problem documents
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/docs/missing", nil)
+	r.Header.Set("accept", "application/json")
+	serveAsset(s)(rec, r)
+	var p problem
+	if err := json.NewDecoder(rec.Body).Decode(&p); err != nil {
+		t.Fatal(err)
+	}
+	want := problem{Type: "about:blank", Title: "Not Found", Status: 404, Detail: "/docs/missing was not found", Instance: "/docs/missing"}
+	if p != want {
+		t.Errorf("got problem %+v, want %+v", p, want)
+	}
+
+	// the root of a translation without a home page falls back to the
+	// English one, see fallbackPage, and gets the 404 page of the
+	// translation otherwise
+	rec = httptest.NewRecorder()
+	serveAsset(s)(rec, httptest.NewRequest("GET", "/ja", nil))
+	if rec.Code != 302 || rec.Header().Get("location") != "/" {
+		t.Errorf("/ja: got %d to %q, want 302 to /", rec.Code, rec.Header().Get("location"))
+	}
+	mem.Delete("goa.design", "index.html")
+	rec = httptest.NewRecorder()
+	serveAsset(s)(rec, httptest.NewRequest("GET", "/ja", nil))
+	if rec.Code != 404 || !strings.Contains(rec.Body.String(), "見つかりません") {
+		t.Errorf("/ja without home page: got %d %q, want 404 %q", rec.Code, rec.Body, "見つかりません")
+	}
+
+	// no 404 page in the bucket
+	mem.Delete("goa.design", "404.html")
+	rec = httptest.NewRecorder()
+	serveAsset(s)(rec, httptest.NewRequest("GET", "/docs/missing", nil))
+	if rec.Code != 404 || rec.Body.String() != "Not Found\n" {
+		t.Errorf("no 404 page: got %d %q", rec.Code, rec.Body)
+	}
+}
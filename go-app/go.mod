@@ -3,12 +3,18 @@ module goa.design
 go 1.25.0
 
 require (
+	github.com/andybalholm/brotli v1.1.1
+	github.com/klauspost/compress v1.18.0
+	github.com/redis/go-redis/v9 v9.17.0
+	golang.org/x/mod v0.30.0
 	golang.org/x/oauth2 v0.36.0
 	google.golang.org/appengine/v2 v2.0.6
 )
 
 require (
 	cloud.google.com/go/compute/metadata v0.8.0 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
 	github.com/golang/protobuf v1.5.0 // indirect
 	golang.org/x/sys v0.35.0 // indirect
 	google.golang.org/protobuf v1.36.11 // indirect
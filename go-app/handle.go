@@ -1,14 +1,11 @@
 package main
 
 import (
-	"encoding/json"
 	"io"
-	"log"
 	"net/http"
-	"sort"
+	"strconv"
 	"strings"
-
-	"google.golang.org/appengine/v2"
+	"time"
 )
 
 // allowMethods is a comma-separated list of allowed HTTP methods,
@@ -21,78 +18,139 @@ func (s *Storage) ServeObject(w http.ResponseWriter, r *http.Request, o *Object)
 	// headers
 	h := w.Header()
 	for k, v := range o.Meta {
+		if strings.HasPrefix(k, "x-goog-meta-") {
+			// custom metadata is for the app, e.g. metaRedirect
+			continue
+		}
+		if k == "vary" {
+			// keep the headers the response already varies with
+			for _, n := range strings.Split(v, ",") {
+				addVary(h, strings.TrimSpace(n))
+			}
+			continue
+		}
 		h.Set(k, v)
 	}
 	h.Set("allow", allowMethods)
-	if o := corsMatch(&s.CORS, r.Header.Get("origin")); o != "" {
-		h.Set("access-control-allow-origin", o)
-		if r.Method == "OPTIONS" {
-			h.Set("access-control-allow-methods", allowMethods)
-			h.Set("access-control-allow-headers", r.Header.Get("access-control-request-headers"))
-			h.Set("access-control-expose-headers", "Location, Etag, Content-Disposition")
-			if s.CORS.MaxAge != "" {
-				h.Set("access-control-max-age", s.CORS.MaxAge)
-			}
-		}
+	if s.CORS.serveCORS(w, r) {
+		// preflight request
+		return nil
 	}
 
 	// redirect
 	if v := o.Redirect(); v != "" && r.Method != "OPTIONS" {
-		h.Set("location", v)
-		w.WriteHeader(o.RedirectCode())
+		return s.serveRedirect(w, r, v, o.RedirectCode())
+	}
+
+	// conditional requests
+	if (r.Method == "GET" || r.Method == "HEAD") && notModified(r, o) {
+		h.Del("content-type")
+		h.Del("content-length")
+		w.WriteHeader(http.StatusNotModified)
 		return nil
 	}
 
-	// body
-	if r.Method == "GET" {
-		_, err := io.Copy(w, o.Body)
-		return err
+	h.Set("accept-ranges", "bytes")
+
+	// partial object retrieved from the backend
+	if o.Meta["content-range"] != "" {
+		if o.Size >= 0 {
+			h.Set("content-length", strconv.FormatInt(o.Size, 10))
+		}
+		w.WriteHeader(http.StatusPartialContent)
+		if r.Method == "GET" {
+			_, err := io.Copy(w, o.Body)
+			return err
+		}
+		return nil
 	}
 
-	return nil
+	// body
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return nil
+	}
+	if body, ok := o.Body.(io.ReadSeeker); ok && r.Method == "GET" && o.Size >= 0 &&
+		r.Header.Get("range") != "" && ifRangeMatch(r, o) {
+		return serveRanges(w, r, o, body)
+	}
+	if o.Size >= 0 {
+		h.Set("content-length", strconv.FormatInt(o.Size, 10))
+	}
+	if r.Method == "HEAD" {
+		return nil
+	}
+	_, err := io.Copy(w, o.Body)
+	return err
 }
 
-// HandleChangeHook handles Object Change Notifications as described at
-// https://cloud.google.com/storage/docs/object-change-notification.
-// It removes objects from cache.
-func (s *Storage) HandleChangeHook(w http.ResponseWriter, r *http.Request) {
-	// skip sync requests
-	if v := r.Header.Get("x-goog-resource-state"); v == "sync" {
-		return
+// withMethods restricts h to the methods of the comma-separated list
+// allow, responding 405 Method Not Allowed to others. OPTIONS requests are
+// answered without calling h, applying cors if not nil.
+func withMethods(allow string, cors *CORS, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !methodAllowed(allow, r.Method) {
+			w.Header().Set("allow", allow)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Method != "OPTIONS" {
+			h(w, r)
+			return
+		}
+		w.Header().Set("allow", allow)
+		if cors != nil && cors.serveCORS(w, r) {
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
 	}
+}
 
-	// this is not a client request, so don't use newContext.
-	ctx := appengine.NewContext(r)
-	// we only care about name and the bucket
-	body := struct{ Name, Bucket string }{}
-	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		log.Printf("[ERROR] json.Decode: %v", err.Error())
-		return
+// notModified reports whether the client copy of o, as described by the
+// If-None-Match or If-Modified-Since headers of r, is current. See
+// RFC 9110, section 13.1.
+func notModified(r *http.Request, o *Object) bool {
+	if inm := r.Header.Get("if-none-match"); inm != "" {
+		etag := o.Meta["etag"]
+		if etag == "" {
+			return false
+		}
+		for _, t := range strings.Split(inm, ",") {
+			t = strings.TrimSpace(t)
+			if t == "*" || weakETagMatch(t, etag) {
+				return true
+			}
+		}
+		// If-Modified-Since is ignored when If-None-Match is present.
+		return false
+	}
+	ims, err := http.ParseTime(r.Header.Get("if-modified-since"))
+	if err != nil {
+		return false
 	}
-	if err := s.PurgeCache(ctx, body.Bucket, body.Name); err != nil {
-		log.Printf("[ERROR] s.PurgeCache(%q, %q): %v", body.Bucket, body.Name, err)
-		w.WriteHeader(http.StatusInternalServerError) // let GCS retry
+	lm, err := http.ParseTime(o.Meta["last-modified"])
+	if err != nil {
+		return false
 	}
+	return !lm.Truncate(time.Second).After(ims)
+}
+
+// weakETagMatch reports whether entity tags a and b match using the weak
+// comparison, i.e. ignoring the W/ weakness indicator.
+func weakETagMatch(a, b string) bool {
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
 }
 
 // ValidMethod reports whether m is a supported HTTP method.
 func ValidMethod(m string) bool {
-	return strings.Contains(allowMethods, m)
+	return methodAllowed(allowMethods, m)
 }
 
-func corsMatch(cors *CORS, o string) string {
-	if len(cors.Origin) == 0 {
-		return ""
-	}
-	if cors.Origin[0] == "*" {
-		return "*"
-	}
-	if cors.Origin[0] == o {
-		return o
-	}
-	i := sort.SearchStrings(cors.Origin, o)
-	if i < len(cors.Origin) && cors.Origin[i] == o {
-		return o
+// methodAllowed reports whether m is in the comma-separated list allow.
+func methodAllowed(allow, m string) bool {
+	for _, a := range strings.Split(allow, ",") {
+		if strings.TrimSpace(a) == m {
+			return true
+		}
 	}
-	return ""
+	return false
 }
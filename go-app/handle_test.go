@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServeObjectConditional(t *testing.T) {
+	const lm = "Mon, 02 Jan 2006 15:04:05 GMT"
+	s, mem := newTestStorage()
+	mem.Put("goa.design", "doc.pdf", map[string]string{
+		"content-type":  "application/pdf",
+		"etag":          `"abc"`,
+		"last-modified": lm,
+	}, []byte("pdf"))
+	cases := []struct {
+		name    string
+		method  string
+		headers map[string]string
+		code    int
+	}{
+		{"no validators", "GET", nil, 200},
+		{"etag match", "GET", map[string]string{"if-none-match": `"abc"`}, 304},
+		{"etag match head", "HEAD", map[string]string{"if-none-match": `"abc"`}, 304},
+		{"etag mismatch", "GET", map[string]string{"if-none-match": `"xyz"`}, 200},
+		{"weak etag", "GET", map[string]string{"if-none-match": `W/"abc"`}, 304},
+		{"etag list", "GET", map[string]string{"if-none-match": `"x", W/"y" ,"abc"`}, 304},
+		{"etag star", "GET", map[string]string{"if-none-match": `*`}, 304},
+		{"etag wins over date", "GET", map[string]string{"if-none-match": `"xyz"`, "if-modified-since": lm}, 200},
+		{"not modified since", "GET", map[string]string{"if-modified-since": lm}, 304},
+		{"modified since", "GET", map[string]string{"if-modified-since": "Mon, 02 Jan 2006 15:04:04 GMT"}, 200},
+		{"invalid date", "GET", map[string]string{"if-modified-since": "yesterday"}, 200},
+	}
+	for _, c := range cases {
+		o, err := s.OpenFile(context.Background(), "goa.design", "doc.pdf")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest(c.method, "/doc.pdf", nil)
+		for k, v := range c.headers {
+			r.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		if err := s.ServeObject(rec, r, o); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+		o.Body.Close()
+		if rec.Code != c.code {
+			t.Errorf("%s: got status %d, want %d", c.name, rec.Code, c.code)
+		}
+		if c.code == http.StatusNotModified {
+			if rec.Body.Len() != 0 {
+				t.Errorf("%s: got body %q", c.name, rec.Body.String())
+			}
+			if rec.Header().Get("etag") != `"abc"` {
+				t.Errorf("%s: missing etag", c.name)
+			}
+			if rec.Header().Get("content-type") != "" {
+				t.Errorf("%s: unexpected content-type", c.name)
+			}
+		}
+	}
+}
+
+func TestWithMethods(t *testing.T) {
+	s, mem := newTestStorage()
+	backend := &countingBackend{MemBackend: mem}
+	s.Backend = backend
+	h := withMethods(allowMethods, &s.CORS, serveAsset(s))
+	cases := []struct {
+		method  string
+		headers map[string]string
+		code    int
+		body    string
+		opens   int
+	}{
+		{"GET", nil, 200, "body{}", 1},
+		{"HEAD", nil, 200, "", 1},
+		{"POST", nil, 405, "Method Not Allowed\n", 0},
+		{"PUT", nil, 405, "Method Not Allowed\n", 0},
+		{"DELETE", nil, 405, "Method Not Allowed\n", 0},
+		{"OPTIONS", nil, 204, "", 0},
+		{"OPTIONS", map[string]string{
+			"origin":                        "https://example.com",
+			"access-control-request-method": "GET",
+		}, 204, "", 0},
+	}
+	for _, c := range cases {
+		backend.opens = 0
+		r := httptest.NewRequest(c.method, "/docs/style.css", nil)
+		for k, v := range c.headers {
+			r.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		h(rec, r)
+		if rec.Code != c.code {
+			t.Errorf("%s: got status %d, want %d", c.method, rec.Code, c.code)
+		}
+		if b := rec.Body.String(); b != c.body {
+			t.Errorf("%s: got body %q, want %q", c.method, b, c.body)
+		}
+		if backend.opens != c.opens {
+			t.Errorf("%s: got %d backend opens, want %d", c.method, backend.opens, c.opens)
+		}
+		if c.code != 200 && rec.Header().Get("allow") != allowMethods {
+			t.Errorf("%s: got allow %q, want %q", c.method, rec.Header().Get("allow"), allowMethods)
+		}
+		if c.method == "HEAD" && rec.Header().Get("content-length") != "6" {
+			t.Errorf("HEAD: got content-length %q, want 6", rec.Header().Get("content-length"))
+		}
+		if c.headers != nil && rec.Header().Get("access-control-allow-methods") != allowMethods {
+			t.Errorf("%s: missing preflight headers", c.method)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// languageCookie is the cookie holding the language chosen by visitors,
+// set when they request an entry point with a query parameter of the same
+// name, e.g. "/?lang=en".
+const languageCookie = "lang"
+
+// languageCookieAge is the max age of the language cookie, in seconds.
+const languageCookieAge = 365 * 24 * 60 * 60
+
+// languageEntries lists the URL paths redirected to the translation of the
+// site in the language preferred by visitors.
+var languageEntries = []string{"/", "/docs/"}
+
+// negotiateLanguage returns the preferred language of the Accept-Language
+// header value al among the translations, or "en". Language ranges match
+// by primary subtag, e.g. "ja-JP" matches "ja". See RFC 9110, section 12.5.4.
+func negotiateLanguage(al string) string {
+	best, bestQ := "en", 0.0
+	for _, part := range strings.Split(al, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		tag, _, _ = strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+		q, ok := qvalue(params)
+		if !ok || q <= bestQ {
+			continue
+		}
+		if tag == "en" || tag == "*" {
+			best, bestQ = "en", q
+			continue
+		}
+		for _, l := range translations {
+			if tag == l {
+				best, bestQ = l, q
+			}
+		}
+	}
+	return best
+}
+
+// validLanguage reports whether the site has a translation in lang.
+func validLanguage(lang string) bool {
+	return lang == "en" || lang != "" && pathLanguage("/"+lang) == lang
+}
+
+// preferredLanguage returns the language chosen with the language query
+// parameter or cookie of r, or negotiated from its Accept-Language header.
+// Visitors coming from another page of the site, e.g. through the language
+// menu, get the page they asked for.
+func preferredLanguage(r *http.Request) string {
+	if l := r.URL.Query().Get(languageCookie); validLanguage(l) {
+		return l
+	}
+	if c, err := r.Cookie(languageCookie); err == nil && validLanguage(c.Value) {
+		return c.Value
+	}
+	if u, err := url.Parse(r.Referer()); err == nil && u.Host != "" && strings.EqualFold(u.Host, r.Host) {
+		return "en"
+	}
+	return negotiateLanguage(r.Header.Get("accept-language"))
+}
+
+// localizeEntry returns the URL the request r of a language entry point
+// is redirected to, the entry point of the translation in the preferred
+// language of the visitor if it exists in the bucket, or "".
+func (s *Storage) localizeEntry(ctx context.Context, w http.ResponseWriter, r *http.Request, bucket string) string {
+	entry := false
+	for _, p := range languageEntries {
+		entry = entry || r.URL.Path == p
+	}
+	if !entry {
+		return ""
+	}
+	// the response depends on the visitor, whether redirected or not
+	addVary(w.Header(), "Accept-Language")
+	addVary(w.Header(), "Cookie")
+	addVary(w.Header(), "Referer")
+	if l := r.URL.Query().Get(languageCookie); validLanguage(l) {
+		http.SetCookie(w, &http.Cookie{
+			Name:     languageCookie,
+			Value:    l,
+			Path:     "/",
+			MaxAge:   languageCookieAge,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	lang := preferredLanguage(r)
+	if lang == "en" {
+		return ""
+	}
+	to := "/" + lang + r.URL.Path
+	o, err := s.OpenFile(ctx, bucket, to[1:])
+	if err != nil {
+		return ""
+	}
+	o.Body.Close()
+	return to
+}
+
+// fallbackPage returns the URL of the English page the request r of a
+// missing translated page is redirected to, or "" if there is none.
+func (s *Storage) fallbackPage(ctx context.Context, r *http.Request, bucket string, err error) string {
+	if !isNotFound(err) {
+		return ""
+	}
+	lang := pathLanguage(r.URL.Path)
+	if lang == "" {
+		return ""
+	}
+	p := strings.TrimPrefix(r.URL.Path, "/"+lang)
+	if p == "" {
+		p = "/"
+	}
+	o, err := s.OpenFile(ctx, bucket, p[1:])
+	if err != nil {
+		return ""
+	}
+	o.Body.Close()
+	return escapePath(p)
+}
+
+// contentLanguage returns the language of the page at URL path p.
+func contentLanguage(p string) string {
+	if l := pathLanguage(p); l != "" {
+		return l
+	}
+	return "en"
+}
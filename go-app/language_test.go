@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateLanguage(t *testing.T) {
+	cases := map[string]string{
+		"":                        "en",
+		"ja":                      "ja",
+		"ja-JP,ja;q=0.9,en;q=0.8": "ja",
+		"en-US,en;q=0.9,fr;q=0.8": "en",
+		"de-DE,de;q=0.9,es;q=0.7": "es",
+		"fr;q=0.5,it;q=0.8":       "it",
+		"de":                      "en",
+		"*":                       "en",
+		"es;q=0, fr":              "fr",
+		"zh-Hant, JA-jp;q=0.5":    "ja",
+	}
+	for al, want := range cases {
+		if got := negotiateLanguage(al); got != want {
+			t.Errorf("%q: got %q, want %q", al, got, want)
+		}
+	}
+}
+
+func TestServeAssetLanguage(t *testing.T) {
+	s, mem := newTestStorage()
+	mem.Put("goa.design", "ja/index.html", map[string]string{"content-type": "text/html"}, []byte("ホーム"))
+	mem.Put("goa.design", "ja/docs/index.html", map[string]string{"content-type": "text/html"}, []byte("ドキュメント"))
+	mem.Put("goa.design", "fr/index.html", map[string]string{"content-type": "text/html"}, []byte("accueil"))
+
+	cases := []struct {
+		path, al, cookie string
+		code             int
+		location         string
+		lang             string
+		vary             string
+		referer          string
+		setCookie        string
+	}{
+		{"/", "", "", 200, "", "en", "Accept-Language, Cookie, Referer, Accept-Encoding", "", ""},
+		{"/", "ja-JP,ja;q=0.9", "", 302, "/ja/", "", "Accept-Language, Cookie, Referer", "", ""},
+		{"/docs/", "ja", "", 302, "/ja/docs/", "", "Accept-Language, Cookie, Referer", "", ""},
+		{"/docs/?v=3", "ja", "", 302, "/ja/docs/?v=3", "", "Accept-Language, Cookie, Referer", "", ""},
+		{"/", "ja", "en", 200, "", "en", "Accept-Language, Cookie, Referer, Accept-Encoding", "", ""},
+		{"/", "", "fr", 302, "/fr/", "", "Accept-Language, Cookie, Referer", "", ""},
+		{"/", "", "xx", 200, "", "en", "Accept-Language, Cookie, Referer, Accept-Encoding", "", ""},
+		// opting out of the negotiation
+		{"/?lang=en", "ja", "", 200, "", "en", "Accept-Language, Cookie, Referer, Accept-Encoding", "", "lang=en"},
+		{"/?lang=en", "", "ja", 200, "", "en", "Accept-Language, Cookie, Referer, Accept-Encoding", "", "lang=en"},
+		{"/docs/?lang=ja", "", "", 302, "/ja/docs/?lang=ja", "", "Accept-Language, Cookie, Referer", "", "lang=ja"},
+		{"/?lang=xx", "ja", "", 302, "/ja/?lang=xx", "", "Accept-Language, Cookie, Referer", "", ""},
+		{"/", "ja", "", 200, "", "en", "Accept-Language, Cookie, Referer, Accept-Encoding", "https://example.com/ja/", ""},
+		{"/", "ja", "", 302, "/ja/", "", "Accept-Language, Cookie, Referer", "https://github.com/goadesign/goa", ""},
+		// no French docs
+		{"/docs/", "fr", "", 200, "", "en", "Accept-Language, Cookie, Referer, Accept-Encoding", "", ""},
+		// not an entry point
+		{"/docs/style.css", "ja", "", 200, "", "", "Accept-Encoding", "", ""},
+		{"/ja/docs/", "", "", 200, "", "ja", "Accept-Encoding", "", ""},
+		// missing translations fall back to English
+		{"/fr/docs/", "fr", "", 302, "/docs/", "", "", "", ""},
+		{"/ja/docs/style.css?v=1", "", "", 302, "/docs/style.css?v=1", "", "", "", ""},
+		{"/ja/missing", "", "", 404, "", "", "Accept", "", ""},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", c.path, nil)
+		if c.al != "" {
+			r.Header.Set("accept-language", c.al)
+		}
+		if c.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: languageCookie, Value: c.cookie})
+		}
+		if c.referer != "" {
+			r.Header.Set("referer", c.referer)
+		}
+		rec := httptest.NewRecorder()
+		serveAsset(s)(rec, r)
+		h := rec.Header()
+		if rec.Code != c.code {
+			t.Errorf("%s %q %q: got status %d, want %d", c.path, c.al, c.cookie, rec.Code, c.code)
+		}
+		if l := h.Get("location"); l != c.location {
+			t.Errorf("%s %q %q: got location %q, want %q", c.path, c.al, c.cookie, l, c.location)
+		}
+		if l := h.Get("content-language"); l != c.lang {
+			t.Errorf("%s %q %q: got content-language %q, want %q", c.path, c.al, c.cookie, l, c.lang)
+		}
+		if v := h.Get("vary"); v != c.vary {
+			t.Errorf("%s %q %q: got vary %q, want %q", c.path, c.al, c.cookie, v, c.vary)
+		}
+		if sc := h.Get("set-cookie"); !strings.HasPrefix(sc, c.setCookie) || (c.setCookie == "") != (sc == "") {
+			t.Errorf("%s %q %q: got set-cookie %q, want %q", c.path, c.al, c.cookie, sc, c.setCookie)
+		}
+	}
+}
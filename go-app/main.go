@@ -2,9 +2,11 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"strings"
 	"text/template"
 	"time"
@@ -12,88 +14,198 @@ import (
 	"google.golang.org/appengine/v2"
 )
 
-var goaImportT = template.Must(template.New("goaImport").Parse(goaImport))
 var packageImportT = template.Must(template.New("packageImport").Parse(packageImport))
 
 func main() {
-	h := withDeployMemcacheFlush
-	http.HandleFunc("/", h(serveAsset(DefaultStorage)))
-	http.HandleFunc("/goa", h(serveGoa("v2")))
-	http.HandleFunc("/goa/", h(serveGoa("v2")))
-	http.HandleFunc("/goa/v3", h(serveGoa("v3")))
-	http.HandleFunc("/goa/v3/", h(serveGoa("v3")))
-	http.HandleFunc("/plugins/", h(servePackage("plugins")))
-	http.HandleFunc("/examples/", h(servePackage("examples")))
-	http.HandleFunc("/structurizr", h(servePackage("structurizr")))
-	http.HandleFunc("/structurizr/", h(servePackage("structurizr")))
-	http.HandleFunc("/model", h(servePackage("model")))
-	http.HandleFunc("/model/", h(servePackage("model")))
-	http.HandleFunc("/clue", h(servePackage("clue")))
-	http.HandleFunc("/clue/", h(servePackage("clue")))
-	http.HandleFunc("/pulse", h(servePackage("pulse")))
-	http.HandleFunc("/pulse/", h(servePackage("pulse")))
-	http.HandleFunc("/goa-ai", h(servePackage("goa-ai")))
-	http.HandleFunc("/goa-ai/", h(servePackage("goa-ai")))
-	appengine.Main()
-}
+	addr := flag.String("addr", "", "serve on `address` as a standalone server instead of App Engine, e.g. \":8080\"")
+	checkRedirects := flag.String("check-redirects", "", "validate the redirect map `file` and exit")
+	flag.Parse()
+	if v := os.Getenv("REDIRECT_HOSTS"); v != "" {
+		DefaultStorage.RedirectHosts = strings.Split(v, ",")
+	}
+	if *checkRedirects != "" {
+		m, err := LoadRedirects(*checkRedirects)
+		if err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+		fmt.Printf("%s: %d redirect rules OK\n", *checkRedirects, len(m.Rules))
+		return
+	}
+	if *addr != "" {
+		platform = StandalonePlatform
+		platform.ForwardedProto = envBool("TRUST_FORWARDED_PROTO")
+	}
 
-func serveGoa(v string) func(http.ResponseWriter, *http.Request) {
-	p := ""
-	if v != "v2" {
-		p = "/" + v
+	reg, err := LoadRegistry(os.Getenv("MODULES_CONFIG"))
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
 	}
-	return func(w http.ResponseWriter, r *http.Request) {
-		path := strings.TrimPrefix(r.URL.Path, "goa.design/goa"+p)
-		// w.Header().Set("Cache-Control", "public, max-age=86400")
-		w.Header().Set("Cache-Control", "no-cache")
-		if err := goaImportT.Execute(w, struct {
-			Version string
-			Prefix  string
-			Path    string
-		}{
-			Version: v,
-			Prefix:  p,
-			Path:    path,
-		}); err != nil {
-			http.Error(w, fmt.Sprintf("failed to render the page (%s)", err.Error()), http.StatusInternalServerError)
+	if dir := os.Getenv("STORAGE_DIR"); dir != "" {
+		// serve a local directory, e.g. the hugo public directory
+		DefaultStorage.Backend = &DirBackend{Root: dir}
+	}
+	if p := os.Getenv("CORS_CONFIG"); p != "" {
+		cors, err := LoadCORS(p)
+		if err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+		DefaultStorage.CORS = *cors
+	}
+	redirects, err := LoadRedirects(os.Getenv("REDIRECTS_CONFIG"))
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	DefaultStorage.Redirects = &Redirects{
+		Default: redirects,
+		Bucket:  "goa.design",
+		Name:    os.Getenv("REDIRECTS_OBJECT"),
+	}
+	if DefaultStorage.Cache, err = NewCache(os.Getenv("CACHE")); err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	for name, d := range map[string]*time.Duration{
+		"CACHE_MAX_AGE":                &DefaultStorage.MaxAge,
+		"CACHE_STALE_WHILE_REVALIDATE": &DefaultStorage.StaleWhileRevalidate,
+		"CACHE_STALE_IF_ERROR":         &DefaultStorage.StaleIfError,
+		"INDEX_TIMEOUT":                &DefaultStorage.IndexTimeout,
+		"REDIRECTS_RELOAD":             &DefaultStorage.Redirects.Interval,
+	} {
+		if *d, err = envDuration(name, *d); err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+	}
+	sec := DefaultSecurityHeaders
+	if p := os.Getenv("SECURITY_CONFIG"); p != "" {
+		if sec, err = LoadSecurityHeaders(p); err != nil {
+			log.Fatalf("[ERROR] %v", err)
 		}
 	}
+	sh := func(next http.HandlerFunc) http.HandlerFunc {
+		return withSecurityHeaders(sec, next)
+	}
+	h := func(next http.HandlerFunc) http.HandlerFunc {
+		return sh(withDeployMemcacheFlush(next))
+	}
+	http.HandleFunc("/", h(withMethods(allowMethods, &DefaultStorage.CORS, serveAsset(DefaultStorage))))
+	pkg := withSecurityHeaders(sec.packages(), withDeployMemcacheFlush(withMethods(allowMethods, nil, servePackage(reg))))
+	for _, m := range reg.Modules {
+		http.HandleFunc("/"+m.Path, pkg)
+		http.HandleFunc("/"+m.Path+"/", pkg)
+	}
+	if auth := pushAuth(); auth != nil {
+		if DefaultStorage.Cache != nil && !sharedCache(DefaultStorage.Cache) {
+			log.Printf("[INFO] push notifications only purge the cache of the instance receiving them, set CACHE to memcache or redis")
+		}
+		http.HandleFunc("/_ah/push-handlers/storage", sh(withMethods("POST", nil, DefaultStorage.HandlePush(auth))))
+	}
+	warm, err := warmOptions()
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	// the deploy flush must happen before warming the cache
+	http.HandleFunc("/_ah/warmup", h(serveWarmup(DefaultStorage, "goa.design", warm)))
+	if token := os.Getenv("ADMIN_TOKEN"); token != "" {
+		http.HandleFunc("/_admin/purge", sh(withMethods("POST", nil, withAdmin(token, servePurge(DefaultStorage, "goa.design")))))
+		http.HandleFunc("/_admin/warm", sh(withMethods("POST", nil, withAdmin(token, serveWarm(DefaultStorage, "goa.design", warm)))))
+	}
+	if envBool("SERVE_GOPROXY") {
+		http.HandleFunc("/proxy/", h(withMethods(allowMethods, nil, serveProxy(reg, DefaultStorage, "goa.design"))))
+	}
+
+	if *addr == "" {
+		appengine.Main()
+		return
+	}
+	if err := serveStandalone(*addr, http.DefaultServeMux); err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
 }
 
-func servePackage(pkg string) func(http.ResponseWriter, *http.Request) {
+func servePackage(reg *Registry) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		path := strings.TrimPrefix(r.URL.Path, "goa.design/"+pkg)
+		ip := reg.Resolve(r.URL.Path)
+		if ip == nil {
+			http.NotFound(w, r)
+			return
+		}
 		// w.Header().Set("Cache-Control", "public, max-age=86400")
 		w.Header().Set("Cache-Control", "no-cache")
-		if err := packageImportT.Execute(w, struct {
-			Pkg  string
-			Path string
-		}{
-			Pkg:  pkg,
-			Path: path,
+		if !isGoGet(r) {
+			// browsers go straight to the package documentation
+			http.Redirect(w, r, ip.DocURL(), http.StatusFound)
+			return
+		}
+		if err := packageImportT.Execute(w, packageImportData{
+			Root:    ip.Root,
+			VCS:     ip.Module.VCS,
+			Version: ip.Version,
 		}); err != nil {
 			http.Error(w, fmt.Sprintf("failed to render the page (%s)", err.Error()), http.StatusInternalServerError)
 		}
 	}
 }
 
+// packageImportData is the data rendered by packageImportT.
+type packageImportData struct {
+	Root string // module root import path, e.g. "goa.design/goa/v3"
+	VCS  string
+	*Version
+}
+
+// isGoGet reports whether r was issued by the go command resolving an
+// import path, see https://go.dev/ref/mod#vcs-find.
+func isGoGet(r *http.Request) bool {
+	return r.URL.Query().Get("go-get") == "1"
+}
+
 func serveAsset(s *Storage) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		ctx, cancel := context.WithTimeout(appengine.NewContext(r), 10*time.Second)
+		if isGoGet(r) {
+			// not a registered module, don't let the go command
+			// mistake a site page for an import page
+			http.NotFound(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(platform.NewContext(r), 10*time.Second)
 		defer cancel()
 		oname := r.URL.Path[1:]
-		o, err := s.OpenFile(ctx, "goa.design", oname)
+		if to, code, err := s.Redirects.Resolve(ctx, s.Backend, r.URL.Path); err != nil {
+			log.Printf("[ERROR] %v", err)
+		} else if to != "" {
+			if err := s.serveRedirect(w, r, to, code); err != nil {
+				log.Printf("[ERROR] %v", err)
+			}
+			return
+		}
+		if to := s.localizeEntry(ctx, w, r, "goa.design"); to != "" {
+			if err := s.serveRedirect(w, r, to, http.StatusFound); err != nil {
+				log.Printf("[ERROR] %v", err)
+			}
+			return
+		}
+		var rng string
+		if r.Method == "GET" && r.Header.Get("if-range") == "" {
+			// let the backend retrieve the range of objects not in cache
+			rng = r.Header.Get("range")
+		}
+		o, err := s.OpenFileRange(ctx, "goa.design", oname, rng)
 		if err != nil {
-			code := http.StatusInternalServerError
-			if errf, ok := err.(*FetchError); ok {
-				code = errf.Code
+			if to := s.fallbackPage(ctx, r, "goa.design", err); to != "" {
+				if err := s.serveRedirect(w, r, to, http.StatusFound); err != nil {
+					log.Printf("[ERROR] %v", err)
+				}
+				return
 			}
-			w.WriteHeader(code)
-			if code != http.StatusNotFound {
+			if !isNotFound(err) {
 				log.Printf("[ERROR] %s/%s: %v", "goa.design", oname, err)
 			}
+			s.serveError(ctx, w, r, "goa.design", err)
 			return
 		}
+		if strings.HasPrefix(o.Meta["content-type"], "text/html") {
+			w.Header().Set("content-language", contentLanguage(r.URL.Path))
+		}
+		o = s.encodeObject(ctx, r, "goa.design", o)
 		if err := s.ServeObject(w, r, o); err != nil {
 			log.Printf("[ERROR] %s/%s: %v", "goa.design", oname, err)
 		}
@@ -101,28 +213,13 @@ func serveAsset(s *Storage) func(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-const goaImport = `<!DOCTYPE html>
-<html xmlns="http://www.w3.org/1999/xhtml" xml:lang="en" lang="en-us">
-<head>
-  <meta http-equiv="content-type" content="text/html; charset=utf-8">
-  <!-- Go Imports -->
-  <meta name="go-import" content="goa.design/goa{{ .Prefix }} git https://gopkg.in/goadesign/goa.{{ .Version }}">
-  <meta name="go-source" content="goa.design/goa{{ .Prefix }} https://github.com/goadesign/goa https://github.com/goadesign/goa/tree/{{ .Version }}/{/dir} https://github.com/goadesign/goa/blob/{{ .Version }}{/dir}/{file}#L{line}">
-  <meta http-equiv="refresh" content="0; url=https://pkg.go.dev/goa.design/goa{{ .Path }}">
-</head>
-<body>
-</body>
-</html>
-`
-
 const packageImport = `<!DOCTYPE html>
 <html xmlns="http://www.w3.org/1999/xhtml" xml:lang="en" lang="en-us">
 <head>
   <meta http-equiv="content-type" content="text/html; charset=utf-8">
   <!-- Go Imports -->
-  <meta name="go-import" content="goa.design/{{ .Pkg }} git https://github.com/goadesign/{{ .Pkg }}">
-  <meta name="go-source" content="goa.design/{{ .Pkg }} https://github.com/goadesign/{{ .Pkg }} https://github.com/goadesign/{{ .Pkg }}/tree/main/{/dir} https://github.com/goadesign/{{ .Pkg }}/blob/main{/dir}/{file}#L{line}">
-  <meta http-equiv="refresh" content="0; url=https://pkg.go.dev/goa.design{{ .Path }}">
+  <meta name="go-import" content="{{ .Root }} {{ .VCS }} {{ .Repo }}">
+  <meta name="go-source" content="{{ .Root }} {{ .Source }} {{ .Source }}/tree/{{ .Branch }}{/dir} {{ .Source }}/blob/{{ .Branch }}{/dir}/{file}#L{line}">
 </head>
 <body>
 </body>
@@ -2,42 +2,119 @@ package main
 
 import (
 	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
 )
 
-func TestGoaTemplate(t *testing.T) {
-	const (
-		v    = "v1.0.0"
-		p    = "prefix"
-		path = "path"
-	)
+func TestMain(m *testing.M) {
+	// tests run outside of App Engine
+	platform = StandalonePlatform
+	os.Exit(m.Run())
+}
+
+func TestPackageTemplate(t *testing.T) {
 	var b bytes.Buffer
-	if err := goaImportT.Execute(&b, struct {
-		Version string
-		Prefix  string
-		Path    string
-	}{
-		Version: v,
-		Prefix:  p,
-		Path:    path,
+	if err := packageImportT.Execute(&b, packageImportData{
+		Root:    "goa.design/pkg/v2",
+		VCS:     "git",
+		Version: &Version{Major: 2, Repo: "repo", Source: "source", Branch: "v2"},
 	}); err != nil {
 		t.Fatalf("failed to run template: %s", err)
 	}
 }
 
-func TestPackageTemplate(t *testing.T) {
-	const (
-		pkg  = "pkg"
-		path = "path"
-	)
-	var b bytes.Buffer
-	if err := packageImportT.Execute(&b, struct {
-		Pkg  string
-		Path string
+func TestDefaultRegistry(t *testing.T) {
+	reg, err := LoadRegistry("")
+	if err != nil {
+		t.Fatalf("failed to load default registry: %s", err)
+	}
+	for _, m := range reg.Modules {
+		rec := httptest.NewRecorder()
+		servePackage(reg)(rec, httptest.NewRequest("GET", "/"+m.Path+"?go-get=1", nil))
+		want := `<meta name="go-import" content="goa.design/` + m.Path + " git " + m.Repo + `">`
+		if body := rec.Body.String(); !strings.Contains(body, want) {
+			t.Errorf("%s: go-import not found in\n%s", m.Path, body)
+		}
+	}
+}
+
+func TestServePackageVersions(t *testing.T) {
+	reg, err := LoadRegistry("")
+	if err != nil {
+		t.Fatalf("failed to load default registry: %s", err)
+	}
+	cases := []struct {
+		path                     string
+		goImport, goSourceBranch string
 	}{
-		Pkg:  pkg,
-		Path: path,
-	}); err != nil {
-		t.Fatalf("failed to run template: %s", err)
+		{"/goa", "goa.design/goa git https://gopkg.in/goadesign/goa.v2", "v2"},
+		{"/goa/dsl", "goa.design/goa git https://gopkg.in/goadesign/goa.v2", "v2"},
+		{"/goa/v3", "goa.design/goa/v3 git https://gopkg.in/goadesign/goa.v3", "v3"},
+		{"/goa/v3/dsl", "goa.design/goa/v3 git https://gopkg.in/goadesign/goa.v3", "v3"},
+		{"/plugins/v3/cors", "goa.design/plugins/v3 git https://github.com/goadesign/plugins", "main"},
+		{"/clue/v2x/log", "goa.design/clue git https://github.com/goadesign/clue", "main"},
+	}
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		servePackage(reg)(rec, httptest.NewRequest("GET", c.path+"?go-get=1", nil))
+		body := rec.Body.String()
+		if want := `<meta name="go-import" content="` + c.goImport + `">`; !strings.Contains(body, want) {
+			t.Errorf("%s: %s not found in\n%s", c.path, want, body)
+		}
+		if want := "/tree/" + c.goSourceBranch + "{/dir}"; !strings.Contains(body, want) {
+			t.Errorf("%s: %s not found in\n%s", c.path, want, body)
+		}
+	}
+
+	// major versions missing from the registry don't exist
+	for _, p := range []string{"/goa/v4/dsl", "/model/v2/dsl"} {
+		rec := httptest.NewRecorder()
+		servePackage(reg)(rec, httptest.NewRequest("GET", p+"?go-get=1", nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s: got status %d, want %d", p, rec.Code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestServePackageBrowser(t *testing.T) {
+	reg, err := LoadRegistry("")
+	if err != nil {
+		t.Fatalf("failed to load default registry: %s", err)
+	}
+	cases := map[string]string{
+		"/goa":               "https://pkg.go.dev/goa.design/goa",
+		"/goa/v3/dsl":        "https://pkg.go.dev/goa.design/goa/v3/dsl",
+		"/clue/log?go-get=0": "https://pkg.go.dev/goa.design/clue/log",
+		"/model/":            "https://pkg.go.dev/goa.design/model",
+	}
+	for path, loc := range cases {
+		rec := httptest.NewRecorder()
+		servePackage(reg)(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != http.StatusFound {
+			t.Errorf("%s: got status %d, want %d", path, rec.Code, http.StatusFound)
+		}
+		if got := rec.Header().Get("Location"); got != loc {
+			t.Errorf("%s: got location %q, want %q", path, got, loc)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	servePackage(reg)(rec, httptest.NewRequest("GET", "/clue/log?go-get=1", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("go-get: got status %d, want %d", rec.Code, http.StatusOK)
+	}
+	if body := rec.Body.String(); strings.Contains(body, "refresh") {
+		t.Errorf("go-get: unexpected refresh in\n%s", body)
+	}
+}
+
+func TestServeAssetGoGet(t *testing.T) {
+	rec := httptest.NewRecorder()
+	serveAsset(DefaultStorage)(rec, httptest.NewRequest("GET", "/unknown/pkg?go-get=1", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusNotFound)
 	}
 }
@@ -8,9 +8,7 @@ import (
 	"os"
 	"strings"
 	"sync"
-
-	"google.golang.org/appengine/v2"
-	"google.golang.org/appengine/v2/memcache"
+	"time"
 )
 
 const memcacheDeployFlushHeader = "X-Goa-Memcache-Flushed"
@@ -22,7 +20,7 @@ var deployMemcacheFlushState struct {
 
 func withDeployMemcacheFlush(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		ctx := appengine.NewContext(r)
+		ctx := platform.NewContext(r)
 		flushed, err := flushMemcacheOnDeploy(ctx)
 		if err != nil {
 			log.Printf("[ERROR] memcache deploy flush: %v", err)
@@ -43,22 +41,32 @@ func flushMemcacheOnDeploy(ctx context.Context) (bool, error) {
 		return false, nil
 	}
 
-	ver := strings.TrimSpace(appengine.VersionID(ctx))
+	ver := strings.TrimSpace(platform.VersionID(ctx))
 	if ver == "" {
 		return false, fmt.Errorf("version ID not set")
 	}
 
-	if err := memcache.Flush(ctx); err != nil {
-		return false, fmt.Errorf("flush memcache: %w", err)
+	if DefaultStorage.Cache == nil {
+		markDeployMemcacheFlushDone()
+		return false, nil
+	}
+	if err := DefaultStorage.Cache.Flush(ctx); err != nil {
+		return false, fmt.Errorf("flush cache: %w", err)
 	}
 
 	markDeployMemcacheFlushDone()
-	log.Printf("[INFO] memcache flushed for version %q", ver)
+	log.Printf("[INFO] cache flushed for version %q", ver)
 	return true, nil
 }
 
 func shouldFlushMemcacheOnDeploy() bool {
-	switch strings.ToLower(strings.TrimSpace(os.Getenv("FLUSH_MEMCACHE_ON_DEPLOY"))) {
+	return envBool("FLUSH_MEMCACHE_ON_DEPLOY")
+}
+
+// envBool reports whether the environment variable name is set to a
+// true value such as "1" or "yes".
+func envBool(name string) bool {
+	switch strings.ToLower(strings.TrimSpace(os.Getenv(name))) {
 	case "1", "true", "yes", "on":
 		return true
 	case "", "0", "false", "no", "off":
@@ -68,6 +76,20 @@ func shouldFlushMemcacheOnDeploy() bool {
 	}
 }
 
+// envDuration returns the duration the environment variable name is set
+// to, e.g. "90s", or def if it is not set.
+func envDuration(name string, def time.Duration) (time.Duration, error) {
+	v := strings.TrimSpace(os.Getenv(name))
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, v)
+	}
+	return d, nil
+}
+
 func isDeployMemcacheFlushDone() bool {
 	deployMemcacheFlushState.mu.Lock()
 	defer deployMemcacheFlushState.mu.Unlock()
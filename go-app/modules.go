@@ -0,0 +1,219 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+// defaultModules is the module registry used when MODULES_CONFIG is not set.
+//
+//go:embed modules.json
+var defaultModules []byte
+
+// Registry lists the Go modules served under a vanity import host.
+type Registry struct {
+	Host    string    `json:"host"`    // vanity import host, e.g. "goa.design"
+	Modules []*Module `json:"modules"` // modules served under Host
+}
+
+// Module describes a single vanity import path and where its code lives.
+type Module struct {
+	Path   string `json:"path"`   // import path relative to the host, e.g. "clue"
+	VCS    string `json:"vcs"`    // version control system, defaults to "git"
+	Repo   string `json:"repo"`   // repository root URL used in go-import
+	Source string `json:"source"` // repository browse URL used in go-source, defaults to Repo
+	Branch string `json:"branch"` // branch linked from go-source, defaults to "main"
+	Doc    string `json:"doc"`    // documentation base URL, defaults to "https://pkg.go.dev"
+
+	// Versions lists the major versions imported with a "/vN" suffix and
+	// overrides the repository settings for them. Major versions not
+	// listed here don't exist.
+	Versions []*Version `json:"versions"`
+}
+
+// Version describes where the code of a module major version lives.
+// Empty fields default to the values of the enclosing Module.
+type Version struct {
+	Major  int    `json:"major"`  // major version, e.g. 3 for the "/v3" suffix
+	Repo   string `json:"repo"`   // repository root URL used in go-import
+	Source string `json:"source"` // repository browse URL used in go-source
+	Branch string `json:"branch"` // branch or tag linked from go-source
+}
+
+// Version returns the repository settings for major version n of m, or
+// nil if m.Versions doesn't list it. A zero n denotes the unsuffixed
+// module path.
+func (m *Module) Version(n int) *Version {
+	if n == 0 {
+		return &Version{Repo: m.Repo, Source: m.Source, Branch: m.Branch}
+	}
+	for _, v := range m.Versions {
+		if v.Major == n {
+			return v
+		}
+	}
+	return nil
+}
+
+// ImportPath is a Go package import path resolved against a Registry.
+type ImportPath struct {
+	Module  *Module
+	Version *Version
+	Root    string // module root import path, e.g. "goa.design/goa/v3"
+	Sub     string // package path relative to Root, e.g. "dsl", may be empty
+}
+
+// Resolve returns the import path requested by the URL path p, e.g.
+// "/clue/log/sub", or nil if p does not belong to any registered module
+// or major version. When several module paths match, the longest one wins.
+func (reg *Registry) Resolve(p string) *ImportPath {
+	p = path.Clean("/" + p)
+	var m *Module
+	for _, cand := range reg.Modules {
+		prefix := "/" + cand.Path
+		if p != prefix && !strings.HasPrefix(p, prefix+"/") {
+			continue
+		}
+		if m == nil || len(cand.Path) > len(m.Path) {
+			m = cand
+		}
+	}
+	if m == nil {
+		return nil
+	}
+	major, sub := majorVersion(strings.TrimPrefix(p, "/"+m.Path))
+	v := m.Version(major)
+	if v == nil {
+		return nil
+	}
+	root := reg.Host + "/" + m.Path
+	if major > 0 {
+		root += fmt.Sprintf("/v%d", major)
+	}
+	return &ImportPath{
+		Module:  m,
+		Version: v,
+		Root:    root,
+		Sub:     strings.TrimPrefix(sub, "/"),
+	}
+}
+
+// String returns the full package import path.
+func (ip *ImportPath) String() string {
+	if ip.Sub == "" {
+		return ip.Root
+	}
+	return ip.Root + "/" + ip.Sub
+}
+
+// DocURL returns the URL of the package documentation.
+func (ip *ImportPath) DocURL() string {
+	return ip.Module.Doc + "/" + ip.String()
+}
+
+// majorVersion parses the major version suffix at the beginning of the
+// module-relative path p. It returns the major version, or 0 if p has no
+// such suffix, and the remainder of p. For example "/v3/dsl" yields 3 and
+// "/dsl".
+func majorVersion(p string) (int, string) {
+	elem, rest := p, ""
+	if !strings.HasPrefix(elem, "/v") {
+		return 0, p
+	}
+	elem = elem[2:]
+	if i := strings.IndexByte(elem, '/'); i >= 0 {
+		elem, rest = elem[:i], elem[i:]
+	}
+	// Go requires major version suffixes without leading zeros and
+	// starting at 2, see https://go.dev/ref/mod#major-version-suffixes.
+	if elem == "" || elem[0] == '0' {
+		return 0, p
+	}
+	n, err := strconv.Atoi(elem)
+	if err != nil || n < 2 || strconv.Itoa(n) != elem {
+		return 0, p
+	}
+	return n, rest
+}
+
+// LoadRegistry reads the module registry from the JSON file at path,
+// or from the embedded modules.json if path is empty.
+func LoadRegistry(path string) (*Registry, error) {
+	b := defaultModules
+	if path != "" {
+		var err error
+		if b, err = os.ReadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	return ParseRegistry(b)
+}
+
+// ParseRegistry decodes a JSON module registry, validates it and fills in
+// default values.
+func ParseRegistry(b []byte) (*Registry, error) {
+	var reg Registry
+	if err := json.Unmarshal(b, &reg); err != nil {
+		return nil, fmt.Errorf("decode module registry: %w", err)
+	}
+	if reg.Host == "" {
+		return nil, fmt.Errorf("module registry: missing host")
+	}
+	seen := make(map[string]bool)
+	for i, m := range reg.Modules {
+		m.Path = strings.Trim(m.Path, "/")
+		if m.Path == "" {
+			return nil, fmt.Errorf("module registry: module %d: missing path", i)
+		}
+		// paths are also ServeMux patterns
+		if err := module.CheckImportPath(reg.Host + "/" + m.Path); err != nil {
+			return nil, fmt.Errorf("module registry: module %q: %w", m.Path, err)
+		}
+		if seen[m.Path] {
+			return nil, fmt.Errorf("module registry: duplicate module %q", m.Path)
+		}
+		seen[m.Path] = true
+		if m.Repo == "" {
+			return nil, fmt.Errorf("module registry: module %q: missing repo", m.Path)
+		}
+		if m.VCS == "" {
+			m.VCS = "git"
+		}
+		if m.Source == "" {
+			m.Source = m.Repo
+		}
+		if m.Branch == "" {
+			m.Branch = "main"
+		}
+		if m.Doc == "" {
+			m.Doc = "https://pkg.go.dev"
+		}
+		majors := make(map[int]bool)
+		for _, v := range m.Versions {
+			if v.Major < 2 {
+				return nil, fmt.Errorf("module registry: module %q: invalid major version %d", m.Path, v.Major)
+			}
+			if majors[v.Major] {
+				return nil, fmt.Errorf("module registry: module %q: duplicate major version %d", m.Path, v.Major)
+			}
+			majors[v.Major] = true
+			if v.Repo == "" {
+				v.Repo = m.Repo
+			}
+			if v.Source == "" {
+				v.Source = m.Source
+			}
+			if v.Branch == "" {
+				v.Branch = fmt.Sprintf("v%d", v.Major)
+			}
+		}
+	}
+	return &reg, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import "testing"
+
+func TestParseRegistry(t *testing.T) {
+	cases := map[string]string{
+		"no host":      `{"modules": [{"path": "a", "repo": "r"}]}`,
+		"no path":      `{"host": "h", "modules": [{"repo": "r"}]}`,
+		"no repo":      `{"host": "h", "modules": [{"path": "a"}]}`,
+		"duplicate":    `{"host": "h", "modules": [{"path": "a", "repo": "r"}, {"path": "/a/", "repo": "r"}]}`,
+		"invalid json": `{"host":`,
+		"major 1":      `{"host": "h", "modules": [{"path": "a", "repo": "r", "versions": [{"major": 1}]}]}`,
+		"dup major":    `{"host": "h", "modules": [{"path": "a", "repo": "r", "versions": [{"major": 2}, {"major": 2}]}]}`,
+		"wildcard":     `{"host": "h", "modules": [{"path": "a{b}", "repo": "r"}]}`,
+		"space":        `{"host": "h", "modules": [{"path": "x y", "repo": "r"}]}`,
+		"dot segment":  `{"host": "h", "modules": [{"path": "a/../b", "repo": "r"}]}`,
+		"bad host":     `{"host": "h{", "modules": [{"path": "a", "repo": "r"}]}`,
+	}
+	for name, c := range cases {
+		if _, err := ParseRegistry([]byte(c)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestMajorVersion(t *testing.T) {
+	cases := []struct {
+		p     string
+		major int
+		rest  string
+	}{
+		{"", 0, ""},
+		{"/dsl", 0, "/dsl"},
+		{"/v2", 2, ""},
+		{"/v3/dsl", 3, "/dsl"},
+		{"/v12/a/b", 12, "/a/b"},
+		{"/v1/dsl", 0, "/v1/dsl"},
+		{"/v0", 0, "/v0"},
+		{"/v02", 0, "/v02"},
+		{"/v", 0, "/v"},
+		{"/vendor", 0, "/vendor"},
+	}
+	for _, c := range cases {
+		major, rest := majorVersion(c.p)
+		if major != c.major || rest != c.rest {
+			t.Errorf("majorVersion(%q) = %d, %q; want %d, %q", c.p, major, rest, c.major, c.rest)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	reg, err := LoadRegistry("")
+	if err != nil {
+		t.Fatalf("failed to load default registry: %s", err)
+	}
+	cases := []struct {
+		path      string
+		module    string
+		major     int
+		root, sub string
+		doc       string
+		goImport  string
+		goSource  string
+	}{
+		{"/goa", "goa", 0, "goa.design/goa", "", "https://pkg.go.dev/goa.design/goa", "https://gopkg.in/goadesign/goa.v2", "v2"},
+		{"/goa/", "goa", 0, "goa.design/goa", "", "https://pkg.go.dev/goa.design/goa", "https://gopkg.in/goadesign/goa.v2", "v2"},
+		{"/goa/design/apidsl", "goa", 0, "goa.design/goa", "design/apidsl", "https://pkg.go.dev/goa.design/goa/design/apidsl", "https://gopkg.in/goadesign/goa.v2", "v2"},
+		{"/goa/v3", "goa", 3, "goa.design/goa/v3", "", "https://pkg.go.dev/goa.design/goa/v3", "https://gopkg.in/goadesign/goa.v3", "v3"},
+		{"/goa/v3/http/codegen", "goa", 3, "goa.design/goa/v3", "http/codegen", "https://pkg.go.dev/goa.design/goa/v3/http/codegen", "https://gopkg.in/goadesign/goa.v3", "v3"},
+		{"/plugins/v3/cors", "plugins", 3, "goa.design/plugins/v3", "cors", "https://pkg.go.dev/goa.design/plugins/v3/cors", "https://github.com/goadesign/plugins", "main"},
+		{"/examples/basic/gen/calc", "examples", 0, "goa.design/examples", "basic/gen/calc", "https://pkg.go.dev/goa.design/examples/basic/gen/calc", "https://github.com/goadesign/examples", "main"},
+		{"/structurizr/service", "structurizr", 0, "goa.design/structurizr", "service", "https://pkg.go.dev/goa.design/structurizr/service", "https://github.com/goadesign/structurizr", "main"},
+		{"/model", "model", 0, "goa.design/model", "", "https://pkg.go.dev/goa.design/model", "https://github.com/goadesign/model", "main"},
+		{"/model/dsl", "model", 0, "goa.design/model", "dsl", "https://pkg.go.dev/goa.design/model/dsl", "https://github.com/goadesign/model", "main"},
+		{"/clue/log/sub", "clue", 0, "goa.design/clue", "log/sub", "https://pkg.go.dev/goa.design/clue/log/sub", "https://github.com/goadesign/clue", "main"},
+		{"/clue//log/./sub/", "clue", 0, "goa.design/clue", "log/sub", "https://pkg.go.dev/goa.design/clue/log/sub", "https://github.com/goadesign/clue", "main"},
+		{"/pulse/streaming", "pulse", 0, "goa.design/pulse", "streaming", "https://pkg.go.dev/goa.design/pulse/streaming", "https://github.com/goadesign/pulse", "main"},
+		{"/goa-ai/runtime/agent/planner", "goa-ai", 0, "goa.design/goa-ai", "runtime/agent/planner", "https://pkg.go.dev/goa.design/goa-ai/runtime/agent/planner", "https://github.com/goadesign/goa-ai", "main"},
+	}
+	for _, c := range cases {
+		ip := reg.Resolve(c.path)
+		if ip == nil {
+			t.Errorf("%s: not resolved", c.path)
+			continue
+		}
+		if ip.Module.Path != c.module {
+			t.Errorf("%s: got module %q, want %q", c.path, ip.Module.Path, c.module)
+		}
+		if ip.Version.Major != c.major {
+			t.Errorf("%s: got major %d, want %d", c.path, ip.Version.Major, c.major)
+		}
+		if ip.Root != c.root {
+			t.Errorf("%s: got root %q, want %q", c.path, ip.Root, c.root)
+		}
+		if ip.Sub != c.sub {
+			t.Errorf("%s: got sub %q, want %q", c.path, ip.Sub, c.sub)
+		}
+		if doc := ip.DocURL(); doc != c.doc {
+			t.Errorf("%s: got doc %q, want %q", c.path, doc, c.doc)
+		}
+		if ip.Version.Repo != c.goImport {
+			t.Errorf("%s: got repo %q, want %q", c.path, ip.Version.Repo, c.goImport)
+		}
+		if ip.Version.Branch != c.goSource {
+			t.Errorf("%s: got branch %q, want %q", c.path, ip.Version.Branch, c.goSource)
+		}
+	}
+
+	// every registered module resolves to itself
+	for _, m := range reg.Modules {
+		if ip := reg.Resolve("/" + m.Path + "/a/b"); ip == nil || ip.Module != m || ip.Sub != "a/b" {
+			t.Errorf("%s: failed to resolve nested package", m.Path)
+		}
+	}
+
+	for _, p := range []string{"/", "/docs/", "/goadsl", "/clue-x/log", "/unknown/pkg", "/goa/v4", "/goa/v4/dsl", "/clue/v2/log"} {
+		if ip := reg.Resolve(p); ip != nil {
+			t.Errorf("%s: unexpectedly resolved to %q", p, ip.Root)
+		}
+	}
+}
+
+func TestResolveLongestMatch(t *testing.T) {
+	reg, err := ParseRegistry([]byte(`{"host": "h", "modules": [{"path": "a", "repo": "ra"}, {"path": "a/b", "repo": "rab"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := reg.Resolve("/a/b/c"); ip == nil || ip.Root != "h/a/b" || ip.Sub != "c" {
+		t.Errorf("got %+v, want root h/a/b and sub c", ip)
+	}
+	if ip := reg.Resolve("/a/bc"); ip == nil || ip.Root != "h/a" || ip.Sub != "bc" {
+		t.Errorf("got %+v, want root h/a and sub bc", ip)
+	}
+}
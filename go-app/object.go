@@ -4,21 +4,21 @@ import (
 	"bytes"
 	"context"
 	"io"
-	"log"
+	"maps"
 	"net/http"
 	"strconv"
 	"time"
-
-	"google.golang.org/appengine/v2/memcache"
 )
 
 const (
 	// object custom metadata
 	metaRedirect     = "x-goog-meta-redirect"
 	metaRedirectCode = "x-goog-meta-redirect-code"
+	metaCacheTags    = "x-goog-meta-cache-tags" // comma-separated tags, see Storage.Purge
 
-	// memcache settings
-	cacheItemMax    = 1 << 20 // max size per item, in bytes
+	// cache settings
+	cacheItemMax    = 1 << 20  // max size per memcache item, in bytes
+	cacheObjectMax  = 32 << 20 // max size per cached object, in bytes
 	cacheItemExpiry = 24 * time.Hour
 )
 
@@ -31,14 +31,30 @@ var objectHeaders = []string{
 	"last-modified",
 	metaRedirect,
 	metaRedirectCode,
+	metaCacheTags,
+	"content-range", // partial objects only
 }
 
 // Object represents a single GCS object.
 type Object struct {
+	Name string // object name in its bucket, set by Storage
 	Meta map[string]string
 	Body io.ReadCloser
+	Size int64 // Body length in bytes, -1 if unknown
+}
+
+// bytesBody is a seekable Object.Body holding the object in memory.
+type bytesBody struct {
+	*bytes.Reader
 }
 
+func newBytesBody(b []byte) bytesBody {
+	return bytesBody{bytes.NewReader(b)}
+}
+
+// Close implements io.Closer.
+func (bytesBody) Close() error { return nil }
+
 // Redirect returns o's redirect URL, zero string otherwise.
 func (o *Object) Redirect() string {
 	return o.Meta[metaRedirect]
@@ -56,36 +72,51 @@ func (o *Object) RedirectCode() int {
 
 // objectBuf implements io.ReadCloser for Object.Body.
 // It stores all r.Read results in its buf and caches exported fields
-// in memcache when Read returns io.EOF.
+// in cache when Read returns io.EOF.
 type objectBuf struct {
-	Meta map[string]string
-	Body []byte // set after rc returns io.EOF
+	Meta    map[string]string
+	Body    []byte    // set after rc returns io.EOF
+	Fetched time.Time // time the object was retrieved or last revalidated
+	Source  string    // entity tag of the object an encoded variant derives from
 
-	r   io.Reader
-	buf bytes.Buffer
-	key string          // cache key
-	ctx context.Context // memcache context
+	r      io.Reader
+	buf    bytes.Buffer
+	cache  Cache
+	key    string          // cache key
+	expiry time.Duration   // cache item expiration, cacheItemExpiry if zero
+	ctx    context.Context // cache context
+}
+
+// cacheExpiry returns the expiration of the cache item of b.
+func (b *objectBuf) cacheExpiry() time.Duration {
+	if b.expiry == 0 {
+		return cacheItemExpiry
+	}
+	return b.expiry
 }
 
 func (b *objectBuf) Read(p []byte) (int, error) {
 	n, err := b.r.Read(p)
-	if n > 0 && b.buf.Len() < cacheItemMax {
+	if n > 0 && b.buf.Len() < cacheObjectMax {
 		b.buf.Write(p[:n])
 	}
-	if err == io.EOF && b.buf.Len() < cacheItemMax {
+	if err == io.EOF && b.buf.Len() < cacheObjectMax {
 		b.Body = b.buf.Bytes()
-		item := memcache.Item{
-			Key:        b.key,
-			Object:     b,
-			Expiration: cacheItemExpiry,
-		}
-		if err := memcache.Gob.Set(b.ctx, &item); err != nil {
-			log.Printf("[ERROR] memcache.Gob.Set(%q): %v", b.key, err)
-		}
+		setCache(b.ctx, b.cache, b)
 	}
 	return n, err
 }
 
+// object returns the Object cached in b. Its Meta is a copy, which the
+// request may modify while b is revalidated in the background.
+func (b *objectBuf) object() *Object {
+	return &Object{
+		Meta: maps.Clone(b.Meta),
+		Body: newBytesBody(b.Body),
+		Size: int64(len(b.Body)),
+	}
+}
+
 func (b *objectBuf) Close() error {
 	if c, ok := b.r.(io.Closer); ok {
 		return c.Close()
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/urlfetch"
+)
+
+// Platform abstracts the services of the environment hosting the app.
+type Platform struct {
+	// NewContext returns the context of an incoming request.
+	NewContext func(r *http.Request) context.Context
+	// Transport returns the base transport of outgoing requests made on
+	// behalf of ctx.
+	Transport func(ctx context.Context) http.RoundTripper
+	// VersionID returns the identifier of the running app version.
+	// It changes on each deployment.
+	VersionID func(ctx context.Context) string
+	// Memcache reports whether the App Engine memcache service is available.
+	Memcache bool
+	// ForwardedProto reports whether the front end of the app sets the
+	// X-Forwarded-Proto header of requests, which is then trusted.
+	ForwardedProto bool
+}
+
+// AppEnginePlatform runs the app on the App Engine standard environment
+// with the bundled services.
+var AppEnginePlatform = &Platform{
+	NewContext: appengine.NewContext,
+	Transport: func(ctx context.Context) http.RoundTripper {
+		return &urlfetch.Transport{Context: ctx}
+	},
+	VersionID:      appengine.VersionID,
+	Memcache:       true,
+	ForwardedProto: true,
+}
+
+// StandalonePlatform runs the app as a plain net/http server, e.g. on
+// Cloud Run, Kubernetes or a VM. The version ID is read from the VERSION
+// environment variable, falling back to the Cloud Run K_REVISION.
+// X-Forwarded-Proto is only trusted when TRUST_FORWARDED_PROTO is set,
+// see main.
+var StandalonePlatform = &Platform{
+	NewContext: func(r *http.Request) context.Context {
+		return r.Context()
+	},
+	Transport: func(ctx context.Context) http.RoundTripper {
+		return http.DefaultTransport
+	},
+	VersionID: func(ctx context.Context) string {
+		if v := os.Getenv("VERSION"); v != "" {
+			return v
+		}
+		return os.Getenv("K_REVISION")
+	},
+}
+
+// platform is the Platform the app runs on.
+var platform = AppEnginePlatform
+
+// serveStandalone serves h on addr until the process receives SIGTERM or
+// SIGINT, then shuts the server down gracefully.
+func serveStandalone(addr string, h http.Handler) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	errc := make(chan error, 1)
+	go func() {
+		log.Printf("[INFO] listening on %s", addr)
+		errc <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	log.Printf("[INFO] shutting down")
+	sctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(sctx); err != nil {
+		return err
+	}
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
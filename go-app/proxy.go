@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// proxyPrefix is the object name prefix of the module proxy files in the
+// bucket. Files follow the layout of the go command module download cache
+// ($GOMODCACHE/cache/download), e.g. "proxy/goa.design/clue/@v/list", so
+// the bucket can be populated with "go mod download" followed by a copy of
+// the download cache.
+const proxyPrefix = "proxy/"
+
+// serveProxy serves the Go module proxy protocol described at
+// https://go.dev/ref/mod#goproxy-protocol for the modules of reg, reading
+// the module files from the bucket of s. The handler must be mounted under
+// "/proxy/" behind withMethods.
+func serveProxy(reg *Registry, s *Storage, bucket string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(platform.NewContext(r), 30*time.Second)
+		defer cancel()
+
+		p := strings.TrimPrefix(r.URL.Path, "/proxy/")
+		escMod, file, ok := strings.Cut(p, "/@")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		mod, err := module.UnescapePath(escMod)
+		if err != nil || !isProxyModule(reg, mod) {
+			http.NotFound(w, r)
+			return
+		}
+
+		if file == "latest" {
+			serveProxyLatest(ctx, w, s, bucket, escMod)
+			return
+		}
+		file, ok = strings.CutPrefix(file, "v/")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		ctype := "text/plain; charset=utf-8"
+		if file != "list" {
+			ext := path.Ext(file)
+			escVer := strings.TrimSuffix(file, ext)
+			ver, err := module.UnescapeVersion(escVer)
+			if err != nil || !semver.IsValid(ver) {
+				http.NotFound(w, r)
+				return
+			}
+			switch ext {
+			case ".info":
+				ctype = "application/json"
+			case ".mod":
+			case ".zip":
+				ctype = "application/zip"
+			default:
+				http.NotFound(w, r)
+				return
+			}
+		}
+		o, err := s.Open(ctx, bucket, proxyPrefix+escMod+"/@v/"+file)
+		if err != nil {
+			proxyError(w, err)
+			return
+		}
+		defer o.Body.Close()
+		w.Header().Set("content-type", ctype)
+		if file == "list" {
+			w.Header().Set("cache-control", "no-cache")
+		} else {
+			// module versions are immutable
+			w.Header().Set("cache-control", "public, max-age=86400")
+		}
+		if o.Size >= 0 {
+			w.Header().Set("content-length", strconv.FormatInt(o.Size, 10))
+		}
+		if r.Method == "GET" {
+			if _, err := io.Copy(w, o.Body); err != nil {
+				log.Printf("[ERROR] proxy %s: %v", r.URL.Path, err)
+			}
+		}
+	}
+}
+
+// serveProxyLatest serves the .info file of the latest version listed in
+// the @v/list file of the module.
+func serveProxyLatest(ctx context.Context, w http.ResponseWriter, s *Storage, bucket, escMod string) {
+	o, err := s.Open(ctx, bucket, proxyPrefix+escMod+"/@v/list")
+	if err != nil {
+		proxyError(w, err)
+		return
+	}
+	b, err := io.ReadAll(o.Body)
+	o.Body.Close()
+	if err != nil {
+		proxyError(w, err)
+		return
+	}
+	latest := latestVersion(strings.Fields(string(b)))
+	if latest == "" {
+		http.Error(w, "no versions", http.StatusNotFound)
+		return
+	}
+	escVer, err := module.EscapeVersion(latest)
+	if err != nil {
+		proxyError(w, err)
+		return
+	}
+	o, err = s.Open(ctx, bucket, proxyPrefix+escMod+"/@v/"+escVer+".info")
+	if err != nil {
+		if !isNotFound(err) {
+			proxyError(w, err)
+			return
+		}
+		// synthesize the info when the .info file is missing
+		w.Header().Set("content-type", "application/json")
+		w.Header().Set("cache-control", "no-cache")
+		json.NewEncoder(w).Encode(struct{ Version string }{latest})
+		return
+	}
+	defer o.Body.Close()
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("cache-control", "no-cache")
+	io.Copy(w, o.Body)
+}
+
+// latestVersion returns the highest release version of vers, or the
+// highest pre-release version if there are no releases.
+func latestVersion(vers []string) string {
+	var latest, latestPre string
+	for _, v := range vers {
+		if !semver.IsValid(v) {
+			continue
+		}
+		if semver.Prerelease(v) != "" {
+			if latestPre == "" || semver.Compare(v, latestPre) > 0 {
+				latestPre = v
+			}
+			continue
+		}
+		if latest == "" || semver.Compare(v, latest) > 0 {
+			latest = v
+		}
+	}
+	if latest == "" {
+		return latestPre
+	}
+	return latest
+}
+
+// isProxyModule reports whether mod is the root path of a module of reg,
+// including major version suffixes.
+func isProxyModule(reg *Registry, mod string) bool {
+	p, ok := strings.CutPrefix(mod, reg.Host+"/")
+	if !ok {
+		return false
+	}
+	ip := reg.Resolve(p)
+	return ip != nil && ip.Sub == "" && ip.Root == mod
+}
+
+// proxyError responds with the status of a FetchError. The go command
+// treats 404 and 410 as "not found" and any other status as a failure.
+func proxyError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	if isNotFound(err) {
+		code = http.StatusNotFound
+	} else if ferr, ok := err.(*FetchError); ok {
+		code = ferr.Code
+	}
+	if code != http.StatusNotFound {
+		log.Printf("[ERROR] proxy: %v", err)
+	}
+	http.Error(w, http.StatusText(code), code)
+}
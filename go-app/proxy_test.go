@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestServeProxy(t *testing.T) {
+	reg, err := LoadRegistry("")
+	if err != nil {
+		t.Fatalf("failed to load default registry: %s", err)
+	}
+	root := t.TempDir()
+	files := map[string]string{
+		"goa.design/clue/@v/list":               "v1.0.0\nv1.2.0\nv1.10.0-rc.1\n",
+		"goa.design/clue/@v/v1.2.0.info":        `{"Version":"v1.2.0","Time":"2024-01-01T00:00:00Z"}`,
+		"goa.design/clue/@v/v1.2.0.mod":         "module goa.design/clue\n",
+		"goa.design/clue/@v/v1.2.0.zip":         "PK",
+		"goa.design/goa/v3/@v/list":             "v3.16.0\n",
+		"goa.design/goa/v3/@v/v3.16.0.mod":      "module goa.design/goa/v3\n",
+		"goa.design/model/@v/list":              "v1.9.0-beta\n",
+		"goa.design/goa-ai/@v/v0.1.0-!beta.mod": "module goa.design/goa-ai\n",
+	}
+	for name, content := range files {
+		fname := filepath.Join(root, "proxy", filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fname), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fname, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := withMethods(allowMethods, nil, serveProxy(reg, &Storage{Backend: &DirBackend{Root: root}}, "goa.design"))
+
+	cases := []struct {
+		method, path string
+		code         int
+		ctype, body  string
+	}{
+		{"GET", "/proxy/goa.design/clue/@v/list", 200, "text/plain; charset=utf-8", files["goa.design/clue/@v/list"]},
+		{"GET", "/proxy/goa.design/clue/@v/v1.2.0.info", 200, "application/json", files["goa.design/clue/@v/v1.2.0.info"]},
+		{"GET", "/proxy/goa.design/clue/@v/v1.2.0.mod", 200, "text/plain; charset=utf-8", files["goa.design/clue/@v/v1.2.0.mod"]},
+		{"GET", "/proxy/goa.design/clue/@v/v1.2.0.zip", 200, "application/zip", "PK"},
+		{"HEAD", "/proxy/goa.design/clue/@v/v1.2.0.zip", 200, "application/zip", ""},
+		{"GET", "/proxy/goa.design/clue/@latest", 200, "application/json", files["goa.design/clue/@v/v1.2.0.info"]},
+		{"GET", "/proxy/goa.design/goa/v3/@v/v3.16.0.mod", 200, "text/plain; charset=utf-8", files["goa.design/goa/v3/@v/v3.16.0.mod"]},
+		{"GET", "/proxy/goa.design/goa/v3/@latest", 200, "application/json", `{"Version":"v3.16.0"}` + "\n"},
+		{"GET", "/proxy/goa.design/model/@latest", 200, "application/json", `{"Version":"v1.9.0-beta"}` + "\n"},
+		{"GET", "/proxy/goa.design/goa-ai/@v/v0.1.0-!beta.mod", 200, "text/plain; charset=utf-8", files["goa.design/goa-ai/@v/v0.1.0-!beta.mod"]},
+		{"GET", "/proxy/goa.design/clue/@v/v1.3.0.mod", 404, "", ""},
+		{"GET", "/proxy/goa.design/clue/@v/v1.2.0.txt", 404, "", ""},
+		{"GET", "/proxy/goa.design/clue/@v/latest.mod", 404, "", ""},
+		{"GET", "/proxy/goa.design/clue/log/@v/list", 404, "", ""},
+		{"GET", "/proxy/goa.design/pulse/@v/list", 404, "", ""},
+		{"GET", "/proxy/goa.design/unknown/@v/list", 404, "", ""},
+		{"GET", "/proxy/github.com/goadesign/clue/@v/list", 404, "", ""},
+		{"GET", "/proxy/goa.design/Clue/@v/list", 404, "", ""},
+		{"GET", "/proxy/sumdb/sum.golang.org/supported", 404, "", ""},
+		{"POST", "/proxy/goa.design/clue/@v/list", 405, "", ""},
+	}
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest(c.method, c.path, nil))
+		if rec.Code != c.code {
+			t.Errorf("%s %s: got status %d, want %d", c.method, c.path, rec.Code, c.code)
+			continue
+		}
+		if c.code != 200 {
+			continue
+		}
+		if ct := rec.Header().Get("content-type"); ct != c.ctype {
+			t.Errorf("%s %s: got content-type %q, want %q", c.method, c.path, ct, c.ctype)
+		}
+		if body := rec.Body.String(); body != c.body {
+			t.Errorf("%s %s: got body %q, want %q", c.method, c.path, body, c.body)
+		}
+	}
+}
+
+func TestLatestVersion(t *testing.T) {
+	cases := []struct {
+		vers   []string
+		latest string
+	}{
+		{nil, ""},
+		{[]string{"bogus"}, ""},
+		{[]string{"v1.0.0", "v1.10.0", "v1.9.0"}, "v1.10.0"},
+		{[]string{"v1.0.0", "v2.0.0-rc.1"}, "v1.0.0"},
+		{[]string{"v2.0.0-rc.1", "v2.0.0-rc.2"}, "v2.0.0-rc.2"},
+	}
+	for _, c := range cases {
+		if got := latestVersion(c.vers); got != c.latest {
+			t.Errorf("latestVersion(%v) = %q, want %q", c.vers, got, c.latest)
+		}
+	}
+}
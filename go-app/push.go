@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// googleCertsURL serves the keys signing Google OIDC tokens as a JWK set.
+const googleCertsURL = "https://www.googleapis.com/oauth2/v3/certs"
+
+// pushClockSkew is the clock skew tolerated when checking token times.
+const pushClockSkew = time.Minute
+
+// PushAuth verifies that Pub/Sub push requests originate from the
+// subscription, see https://cloud.google.com/pubsub/docs/authenticate-push-subscriptions.
+type PushAuth struct {
+	// Audience is the audience configured for the OIDC tokens of the
+	// push subscription, usually the endpoint URL.
+	Audience string
+	// Email is the service account the tokens are issued for.
+	// Empty accepts any account.
+	Email string
+	// Secret, when set, is accepted as the "token" query parameter of
+	// the endpoint URL instead of an OIDC token.
+	Secret string
+	// Keys returns the RSA public keys signing the tokens, by key ID.
+	// Nil uses the Google OAuth2 certificates.
+	Keys func(ctx context.Context) (map[string]*rsa.PublicKey, error)
+}
+
+// pushAuth returns the PushAuth configured by the PUSH_AUDIENCE,
+// PUSH_SERVICE_ACCOUNT and PUSH_SECRET environment variables, or nil if
+// neither an audience nor a secret is set.
+func pushAuth() *PushAuth {
+	a := &PushAuth{
+		Audience: os.Getenv("PUSH_AUDIENCE"),
+		Email:    os.Getenv("PUSH_SERVICE_ACCOUNT"),
+		Secret:   os.Getenv("PUSH_SECRET"),
+	}
+	if a.Audience == "" && a.Secret == "" {
+		return nil
+	}
+	return a
+}
+
+// errPushAuth is returned for requests without valid credentials.
+var errPushAuth = errors.New("push: unauthorized")
+
+// verify returns an error unless r carries the shared secret or a valid
+// OIDC token.
+func (a *PushAuth) verify(ctx context.Context, r *http.Request) error {
+	if a.Secret != "" {
+		if t := r.URL.Query().Get("token"); t != "" {
+			if subtle.ConstantTimeCompare([]byte(t), []byte(a.Secret)) == 1 {
+				return nil
+			}
+			return errPushAuth
+		}
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("authorization"), "Bearer ")
+	if !ok || a.Audience == "" {
+		return errPushAuth
+	}
+	return a.verifyToken(ctx, token)
+}
+
+// pushClaims are the claims of push OIDC tokens checked by verifyToken.
+type pushClaims struct {
+	Iss           string `json:"iss"`
+	Aud           string `json:"aud"`
+	Exp           int64  `json:"exp"`
+	Iat           int64  `json:"iat"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+// verifyToken checks the RS256 signature and the claims of the JWT token.
+func (a *PushAuth) verifyToken(ctx context.Context, token string) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("%w: malformed token", errPushAuth)
+	}
+	var header struct{ Alg, Kid string }
+	if err := decodeSegment(parts[0], &header); err != nil || header.Alg != "RS256" {
+		return fmt.Errorf("%w: unsupported token header", errPushAuth)
+	}
+	keys := a.Keys
+	if keys == nil {
+		keys = googleKeys.get
+	}
+	ks, err := keys(ctx)
+	if err != nil {
+		return err
+	}
+	key, ok := ks[header.Kid]
+	if !ok {
+		return fmt.Errorf("%w: unknown key %q", errPushAuth, header.Kid)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("%w: malformed signature", errPushAuth)
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig); err != nil {
+		return fmt.Errorf("%w: invalid signature", errPushAuth)
+	}
+
+	var c pushClaims
+	if err := decodeSegment(parts[1], &c); err != nil {
+		return fmt.Errorf("%w: malformed claims", errPushAuth)
+	}
+	now := time.Now()
+	switch {
+	case c.Iss != "accounts.google.com" && c.Iss != "https://accounts.google.com":
+		return fmt.Errorf("%w: issuer %q", errPushAuth, c.Iss)
+	case c.Aud != a.Audience:
+		return fmt.Errorf("%w: audience %q", errPushAuth, c.Aud)
+	case now.After(time.Unix(c.Exp, 0).Add(pushClockSkew)):
+		return fmt.Errorf("%w: token expired", errPushAuth)
+	case now.Add(pushClockSkew).Before(time.Unix(c.Iat, 0)):
+		return fmt.Errorf("%w: token issued in the future", errPushAuth)
+	case a.Email != "" && (c.Email != a.Email || !c.EmailVerified):
+		return fmt.Errorf("%w: account %q", errPushAuth, c.Email)
+	}
+	return nil
+}
+
+// decodeSegment decodes the base64url JSON segment of a JWT into v.
+func decodeSegment(seg string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// googleKeys caches the Google OAuth2 certificates.
+var googleKeys = &keyCache{url: googleCertsURL}
+
+// keyCache fetches and caches a JWK set.
+type keyCache struct {
+	url string
+
+	mu      sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	expires time.Time
+}
+
+// get returns the cached keys, fetching them when missing or expired.
+func (c *keyCache) get(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.keys != nil && time.Now().Before(c.expires) {
+		return c.keys, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", c.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := (&http.Client{Transport: platform.Transport(ctx)}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, &FetchError{Msg: c.url + ": " + res.Status, Code: res.StatusCode}
+	}
+	keys, err := parseJWKS(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	// the keys rotate daily and are published well in advance
+	c.keys, c.expires = keys, time.Now().Add(time.Hour)
+	return keys, nil
+}
+
+// parseJWKS decodes the RSA keys of a JSON Web Key set, see RFC 7517.
+func parseJWKS(r io.Reader) (map[string]*rsa.PublicKey, error) {
+	var set struct {
+		Keys []struct{ Kty, Kid, N, E string }
+	}
+	if err := json.NewDecoder(r).Decode(&set); err != nil {
+		return nil, fmt.Errorf("decode JWK set: %w", err)
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("JWK %q: %w", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("JWK %q: %w", k.Kid, err)
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
+
+// pushEnvelope is the body of Pub/Sub push requests.
+type pushEnvelope struct {
+	Message struct {
+		Attributes map[string]string `json:"attributes"`
+		Data       []byte            `json:"data"` // base64 in JSON
+		MessageID  string            `json:"messageId"`
+	} `json:"message"`
+	Subscription string `json:"subscription"`
+}
+
+// HandlePush handles Cloud Storage Pub/Sub notifications pushed to the
+// app, see https://cloud.google.com/storage/docs/pubsub-notifications.
+// It removes finalized, deleted or updated objects from cache.
+// Requests are rejected unless verified by auth.
+//
+// Pub/Sub delivers each notification to a single instance, so that with
+// a cache that isn't shared, such as the default lru cache of standalone
+// deployments, other instances keep serving the previous objects until
+// they expire. Use memcache or redis when running several instances.
+func (s *Storage) HandlePush(auth *PushAuth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// this is not a client request, so don't use the request timeout
+		ctx := platform.NewContext(r)
+		if err := auth.verify(ctx, r); err != nil {
+			log.Printf("[ERROR] push %s: %v", r.URL.Path, err)
+			code := http.StatusUnauthorized
+			if !errors.Is(err, errPushAuth) {
+				// keys unavailable, let Pub/Sub retry
+				code = http.StatusServiceUnavailable
+			}
+			http.Error(w, http.StatusText(code), code)
+			return
+		}
+
+		var env pushEnvelope
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&env); err != nil {
+			log.Printf("[ERROR] push: decode: %v", err)
+			http.Error(w, "malformed push message", http.StatusBadRequest)
+			return
+		}
+		attrs := env.Message.Attributes
+		switch attrs["eventType"] {
+		case "OBJECT_FINALIZE", "OBJECT_DELETE", "OBJECT_METADATA_UPDATE":
+		default:
+			// e.g. OBJECT_ARCHIVE, acknowledge and ignore
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		bucket, name := attrs["bucketId"], attrs["objectId"]
+		if bucket == "" || name == "" {
+			// JSON_API_V1 payloads carry the object resource
+			var obj struct{ Bucket, Name string }
+			if err := json.Unmarshal(env.Message.Data, &obj); err != nil || obj.Bucket == "" || obj.Name == "" {
+				log.Printf("[ERROR] push %s: missing object", env.Message.MessageID)
+				http.Error(w, "missing object", http.StatusBadRequest)
+				return
+			}
+			bucket, name = obj.Bucket, obj.Name
+		}
+		if err := s.PurgeObject(ctx, bucket, name); err != nil {
+			log.Printf("[ERROR] s.PurgeObject(%q, %q): %v", bucket, name, err)
+			w.WriteHeader(http.StatusInternalServerError) // let Pub/Sub retry
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signToken returns a RS256 JWT with the given claims signed by key.
+func signToken(t *testing.T, key *rsa.PrivateKey, kid string, claims any) string {
+	t.Helper()
+	seg := func(v any) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := seg(map[string]string{"alg": "RS256", "kid": kid, "typ": "JWT"}) + "." + seg(claims)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestPushAuth(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const (
+		aud   = "https://goa.design/_ah/push-handlers/storage"
+		email = "push@goa-design.iam.gserviceaccount.com"
+	)
+	auth := &PushAuth{
+		Audience: aud,
+		Email:    email,
+		Secret:   "s3cret",
+		Keys: func(context.Context) (map[string]*rsa.PublicKey, error) {
+			return map[string]*rsa.PublicKey{"k1": &key.PublicKey}, nil
+		},
+	}
+	now := time.Now().Unix()
+	claims := func(mod func(c *pushClaims)) *pushClaims {
+		c := &pushClaims{
+			Iss:           "https://accounts.google.com",
+			Aud:           aud,
+			Exp:           now + 3600,
+			Iat:           now,
+			Email:         email,
+			EmailVerified: true,
+		}
+		if mod != nil {
+			mod(c)
+		}
+		return c
+	}
+	cases := []struct {
+		name  string
+		token string
+		query string
+		ok    bool
+	}{
+		{"valid", signToken(t, key, "k1", claims(nil)), "", true},
+		{"short issuer", signToken(t, key, "k1", claims(func(c *pushClaims) { c.Iss = "accounts.google.com" })), "", true},
+		{"no credentials", "", "", false},
+		{"wrong audience", signToken(t, key, "k1", claims(func(c *pushClaims) { c.Aud = "https://evil.com" })), "", false},
+		{"wrong issuer", signToken(t, key, "k1", claims(func(c *pushClaims) { c.Iss = "https://evil.com" })), "", false},
+		{"expired", signToken(t, key, "k1", claims(func(c *pushClaims) { c.Exp = now - 3600 })), "", false},
+		{"future", signToken(t, key, "k1", claims(func(c *pushClaims) { c.Iat = now + 3600 })), "", false},
+		{"wrong account", signToken(t, key, "k1", claims(func(c *pushClaims) { c.Email = "evil@example.com" })), "", false},
+		{"unverified account", signToken(t, key, "k1", claims(func(c *pushClaims) { c.EmailVerified = false })), "", false},
+		{"unknown key", signToken(t, key, "k2", claims(nil)), "", false},
+		{"wrong key", signToken(t, other, "k1", claims(nil)), "", false},
+		{"alg none", base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"k1"}`)) + "." +
+			base64.RawURLEncoding.EncodeToString([]byte(`{}`)) + ".", "", false},
+		{"malformed", "not.a.jwt", "", false},
+		{"secret", "", "?token=s3cret", true},
+		{"wrong secret", signToken(t, key, "k1", claims(nil)), "?token=nope", false},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("POST", "/_ah/push-handlers/storage"+c.query, nil)
+		if c.token != "" {
+			r.Header.Set("authorization", "Bearer "+c.token)
+		}
+		err := auth.verify(context.Background(), r)
+		if c.ok && err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+		if !c.ok && err == nil {
+			t.Errorf("%s: expected error", c.name)
+		}
+	}
+}
+
+func TestParseJWKS(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := `{"keys": [
+		{"kty": "RSA", "kid": "k1", "alg": "RS256", "n": "` +
+		base64.RawURLEncoding.EncodeToString(key.N.Bytes()) + `", "e": "` +
+		base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()) + `"},
+		{"kty": "EC", "kid": "k2"}
+	]}`
+	keys, err := parseJWKS(strings.NewReader(set))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || !keys["k1"].Equal(&key.PublicKey) {
+		t.Errorf("got keys %v", keys)
+	}
+}
+
+func TestHandlePush(t *testing.T) {
+	ctx := context.Background()
+	s, mem := newTestStorage()
+	s.Cache = NewLRUCache(1 << 20)
+	h := s.HandlePush(&PushAuth{Secret: "s3cret"})
+
+	read := func(name string) string {
+		t.Helper()
+		o, err := s.OpenFile(ctx, "goa.design", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer o.Body.Close()
+		b, _ := io.ReadAll(o.Body)
+		return string(b)
+	}
+	push := func(query string, attrs map[string]string) int {
+		t.Helper()
+		var env pushEnvelope
+		env.Message.Attributes = attrs
+		b, _ := json.Marshal(env)
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest("POST", "/_ah/push-handlers/storage"+query, strings.NewReader(string(b))))
+		return rec.Code
+	}
+
+	read("docs/")
+	read("docs/style.css")
+	mem.Put("goa.design", "docs/index.html", map[string]string{"content-type": "text/html"}, []byte("docs v2"))
+	mem.Put("goa.design", "docs/style.css", map[string]string{"content-type": "text/css"}, []byte("body{color:red}"))
+
+	if code := push("", map[string]string{"eventType": "OBJECT_FINALIZE", "bucketId": "goa.design", "objectId": "docs/index.html"}); code != 401 {
+		t.Errorf("unauthenticated push: got status %d, want 401", code)
+	}
+	if got := read("docs/"); got != "docs" {
+		t.Errorf("unauthenticated push purged the cache, got %q", got)
+	}
+	if code := push("?token=s3cret", map[string]string{"eventType": "OBJECT_ARCHIVE", "bucketId": "goa.design", "objectId": "docs/index.html"}); code != 204 {
+		t.Errorf("ignored event: got status %d, want 204", code)
+	}
+	if got := read("docs/"); got != "docs" {
+		t.Errorf("ignored event purged the cache, got %q", got)
+	}
+	if code := push("?token=s3cret", map[string]string{"eventType": "OBJECT_FINALIZE", "bucketId": "goa.design", "objectId": "docs/index.html"}); code != 204 {
+		t.Errorf("finalize: got status %d, want 204", code)
+	}
+	if got := read("docs/"); got != "docs v2" {
+		t.Errorf("finalize: got %q, want %q", got, "docs v2")
+	}
+	if got := read("docs/style.css"); got != "body{}" {
+		t.Errorf("finalize purged another object, got %q", got)
+	}
+	mem.Delete("goa.design", "docs/style.css")
+	if code := push("?token=s3cret", map[string]string{"eventType": "OBJECT_DELETE", "bucketId": "goa.design", "objectId": "docs/style.css"}); code != 204 {
+		t.Errorf("delete: got status %d, want 204", code)
+	}
+	if _, err := s.OpenFile(ctx, "goa.design", "docs/style.css"); err == nil {
+		t.Errorf("delete: object still served from cache")
+	}
+	if code := push("?token=s3cret", map[string]string{"eventType": "OBJECT_FINALIZE"}); code != 400 {
+		t.Errorf("missing object: got status %d, want 400", code)
+	}
+}
+
+func TestPurgeObject(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestStorage()
+	s.Cache = NewLRUCache(1 << 20)
+	keys := []string{"docs/index.html", "docs/", "docs", "docs/index.html;br", "docs/index.html;gzip"}
+	for _, k := range keys {
+		s.Cache.Set(ctx, s.CacheKey(ctx, "goa.design", k), []byte("x"), 0)
+	}
+	if err := s.PurgeObject(ctx, "goa.design", "docs/index.html"); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range keys {
+		if _, err := s.Cache.Get(ctx, s.CacheKey(ctx, "goa.design", k)); err != ErrCacheMiss {
+			t.Errorf("%q: still cached", k)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errUnsatisfiableRange is returned by parseRange when none of the
+// requested ranges overlap the object.
+var errUnsatisfiableRange = errors.New("unsatisfiable range")
+
+// byteRange is a range of object bytes.
+type byteRange struct {
+	start, length int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// parseRange parses a Range header value such as "bytes=0-99,-50" against
+// an object of the given size, see RFC 9110, section 14.1.2. It returns
+// nil and no error when the header is malformed, in which case it must be
+// ignored, and errUnsatisfiableRange when no range overlaps the object.
+func parseRange(s string, size int64) ([]byteRange, error) {
+	spec, ok := strings.CutPrefix(s, "bytes=")
+	if !ok {
+		return nil, nil
+	}
+	var ranges []byteRange
+	for _, ra := range strings.Split(spec, ",") {
+		ra = strings.TrimSpace(ra)
+		if ra == "" {
+			continue
+		}
+		first, last, ok := strings.Cut(ra, "-")
+		if !ok {
+			return nil, nil
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+		var r byteRange
+		if first == "" {
+			// suffix range, e.g. "-50" for the last 50 bytes
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, nil
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			n = min(n, size)
+			r = byteRange{start: size - n, length: n}
+		} else {
+			i, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || i < 0 {
+				return nil, nil
+			}
+			j := size - 1
+			if last != "" {
+				if j, err = strconv.ParseInt(last, 10, 64); err != nil || j < i {
+					return nil, nil
+				}
+			}
+			if i >= size {
+				continue
+			}
+			j = min(j, size-1)
+			r = byteRange{start: i, length: j - i + 1}
+		}
+		ranges = append(ranges, r)
+	}
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiableRange
+	}
+	return ranges, nil
+}
+
+// ifRangeMatch reports whether the If-Range precondition of r holds for o,
+// i.e. whether the Range header applies. See RFC 9110, section 13.1.5.
+func ifRangeMatch(r *http.Request, o *Object) bool {
+	ir := r.Header.Get("if-range")
+	if ir == "" {
+		return true
+	}
+	if strings.HasPrefix(ir, `"`) {
+		// strong comparison
+		etag := o.Meta["etag"]
+		return etag != "" && !strings.HasPrefix(etag, "W/") && ir == etag
+	}
+	if strings.HasPrefix(ir, "W/") {
+		return false
+	}
+	t, err := http.ParseTime(ir)
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(o.Meta["last-modified"])
+	return err == nil && lm.Truncate(time.Second).Equal(t)
+}
+
+// serveRanges writes the ranges of o requested by r, reading them from
+// body. It writes the whole object if the ranges do not apply.
+func serveRanges(w http.ResponseWriter, r *http.Request, o *Object, body io.ReadSeeker) error {
+	h := w.Header()
+	h.Set("accept-ranges", "bytes")
+	ranges, err := parseRange(r.Header.Get("range"), o.Size)
+	if err == errUnsatisfiableRange {
+		h.Set("content-range", fmt.Sprintf("bytes */%d", o.Size))
+		h.Del("content-type")
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return nil
+	}
+	var total int64
+	for _, ra := range ranges {
+		total += ra.length
+	}
+	if len(ranges) == 0 || total > o.Size {
+		// malformed or abusive ranges, e.g. overlapping ones
+		h.Set("content-length", strconv.FormatInt(o.Size, 10))
+		_, err := io.Copy(w, body)
+		return err
+	}
+
+	if len(ranges) == 1 {
+		ra := ranges[0]
+		if _, err := body.Seek(ra.start, io.SeekStart); err != nil {
+			return err
+		}
+		h.Set("content-range", ra.contentRange(o.Size))
+		h.Set("content-length", strconv.FormatInt(ra.length, 10))
+		w.WriteHeader(http.StatusPartialContent)
+		_, err := io.CopyN(w, body, ra.length)
+		return err
+	}
+
+	mw := multipart.NewWriter(w)
+	ctype := o.Meta["content-type"]
+	h.Set("content-type", "multipart/byteranges; boundary="+mw.Boundary())
+	w.WriteHeader(http.StatusPartialContent)
+	for _, ra := range ranges {
+		ph := textproto.MIMEHeader{"Content-Range": {ra.contentRange(o.Size)}}
+		if ctype != "" {
+			ph.Set("Content-Type", ctype)
+		}
+		pw, err := mw.CreatePart(ph)
+		if err != nil {
+			return err
+		}
+		if _, err := body.Seek(ra.start, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(pw, body, ra.length); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
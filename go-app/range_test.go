@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestParseRange(t *testing.T) {
+	cases := []struct {
+		header string
+		size   int64
+		ranges []byteRange
+		err    error
+	}{
+		{"bytes=0-4", 10, []byteRange{{0, 5}}, nil},
+		{"bytes=5-", 10, []byteRange{{5, 5}}, nil},
+		{"bytes=-3", 10, []byteRange{{7, 3}}, nil},
+		{"bytes=-30", 10, []byteRange{{0, 10}}, nil},
+		{"bytes=8-20", 10, []byteRange{{8, 2}}, nil},
+		{"bytes=0-0, 2-3 ,-1", 10, []byteRange{{0, 1}, {2, 2}, {9, 1}}, nil},
+		{"bytes=0-1,10-12", 10, []byteRange{{0, 2}}, nil},
+		{"bytes=10-12", 10, nil, errUnsatisfiableRange},
+		{"bytes=-0", 10, nil, errUnsatisfiableRange},
+		{"bytes=0-", 0, nil, errUnsatisfiableRange},
+		{"bytes=4-2", 10, nil, nil},
+		{"bytes=a-b", 10, nil, nil},
+		{"bytes=5", 10, nil, nil},
+		{"items=0-4", 10, nil, nil},
+	}
+	for _, c := range cases {
+		ranges, err := parseRange(c.header, c.size)
+		if err != c.err || !reflect.DeepEqual(ranges, c.ranges) {
+			t.Errorf("parseRange(%q, %d) = %v, %v; want %v, %v", c.header, c.size, ranges, err, c.ranges, c.err)
+		}
+	}
+}
+
+func TestServeObjectRange(t *testing.T) {
+	const lm = "Mon, 02 Jan 2006 15:04:05 GMT"
+	s, mem := newTestStorage()
+	mem.Put("goa.design", "video.mp4", map[string]string{
+		"content-type":  "video/mp4",
+		"etag":          `"v1"`,
+		"last-modified": lm,
+	}, []byte("0123456789"))
+	cases := []struct {
+		name         string
+		method       string
+		headers      map[string]string
+		code         int
+		contentRange string
+		body         string
+	}{
+		{"full", "GET", nil, 200, "", "0123456789"},
+		{"single", "GET", map[string]string{"range": "bytes=2-4"}, 206, "bytes 2-4/10", "234"},
+		{"suffix", "GET", map[string]string{"range": "bytes=-2"}, 206, "bytes 8-9/10", "89"},
+		{"open ended", "GET", map[string]string{"range": "bytes=7-"}, 206, "bytes 7-9/10", "789"},
+		{"unsatisfiable", "GET", map[string]string{"range": "bytes=20-"}, 416, "bytes */10", ""},
+		{"malformed", "GET", map[string]string{"range": "bytes=x"}, 200, "", "0123456789"},
+		{"head", "HEAD", map[string]string{"range": "bytes=2-4"}, 200, "", ""},
+		{"if-range etag", "GET", map[string]string{"range": "bytes=0-1", "if-range": `"v1"`}, 206, "bytes 0-1/10", "01"},
+		{"if-range stale etag", "GET", map[string]string{"range": "bytes=0-1", "if-range": `"v0"`}, 200, "", "0123456789"},
+		{"if-range weak etag", "GET", map[string]string{"range": "bytes=0-1", "if-range": `W/"v1"`}, 200, "", "0123456789"},
+		{"if-range date", "GET", map[string]string{"range": "bytes=0-1", "if-range": lm}, 206, "bytes 0-1/10", "01"},
+		{"if-range old date", "GET", map[string]string{"range": "bytes=0-1", "if-range": "Sun, 01 Jan 2006 15:04:05 GMT"}, 200, "", "0123456789"},
+		{"overlapping", "GET", map[string]string{"range": "bytes=0-9,0-9"}, 200, "", "0123456789"},
+	}
+	for _, c := range cases {
+		o, err := s.OpenFile(context.Background(), "goa.design", "video.mp4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest(c.method, "/video.mp4", nil)
+		for k, v := range c.headers {
+			r.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		if err := s.ServeObject(rec, r, o); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+		o.Body.Close()
+		if rec.Code != c.code {
+			t.Errorf("%s: got status %d, want %d", c.name, rec.Code, c.code)
+		}
+		if cr := rec.Header().Get("content-range"); cr != c.contentRange {
+			t.Errorf("%s: got content-range %q, want %q", c.name, cr, c.contentRange)
+		}
+		if b := rec.Body.String(); b != c.body {
+			t.Errorf("%s: got body %q, want %q", c.name, b, c.body)
+		}
+		if ar := rec.Header().Get("accept-ranges"); ar != "bytes" {
+			t.Errorf("%s: got accept-ranges %q", c.name, ar)
+		}
+		if cl := rec.Header().Get("content-length"); c.method == "GET" && rec.Code != 416 && cl != strconv.Itoa(len(c.body)) {
+			t.Errorf("%s: got content-length %q, want %d", c.name, cl, len(c.body))
+		}
+	}
+}
+
+func TestServeObjectMultiRange(t *testing.T) {
+	s, mem := newTestStorage()
+	mem.Put("goa.design", "doc.pdf", map[string]string{"content-type": "application/pdf"}, []byte("0123456789"))
+	o, err := s.OpenFile(context.Background(), "goa.design", "doc.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/doc.pdf", nil)
+	r.Header.Set("range", "bytes=0-1,-3")
+	rec := httptest.NewRecorder()
+	if err := s.ServeObject(rec, r, o); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("got status %d", rec.Code)
+	}
+	mt, params, err := mime.ParseMediaType(rec.Header().Get("content-type"))
+	if err != nil || mt != "multipart/byteranges" {
+		t.Fatalf("got content-type %q", rec.Header().Get("content-type"))
+	}
+	mr := multipart.NewReader(rec.Body, params["boundary"])
+	want := []struct{ contentRange, body string }{{"bytes 0-1/10", "01"}, {"bytes 7-9/10", "789"}}
+	for _, w := range want {
+		p, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(p)
+		if cr := p.Header.Get("content-range"); cr != w.contentRange || string(b) != w.body {
+			t.Errorf("got part %q %q, want %q %q", cr, b, w.contentRange, w.body)
+		}
+		if ct := p.Header.Get("content-type"); ct != "application/pdf" {
+			t.Errorf("got part content-type %q", ct)
+		}
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Errorf("got %v, want EOF", err)
+	}
+}
+
+func TestServeAssetRangeUpstream(t *testing.T) {
+	defer func(f func(context.Context, ...string) oauth2.TokenSource) { AETokenSource = f }(AETokenSource)
+	AETokenSource = func(context.Context, ...string) oauth2.TokenSource {
+		return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token"})
+	}
+	var gotRange string
+	gcs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/goa.design/big.zip" {
+			http.NotFound(w, r)
+			return
+		}
+		gotRange = r.Header.Get("range")
+		w.Header().Set("content-type", "application/zip")
+		if gotRange == "bytes=2-4" {
+			w.Header().Set("content-range", "bytes 2-4/10")
+			w.WriteHeader(http.StatusPartialContent)
+			io.WriteString(w, "234")
+			return
+		}
+		io.WriteString(w, "0123456789")
+	}))
+	defer gcs.Close()
+	s := &Storage{Backend: &GCSBackend{Base: gcs.URL}, Index: "index.html"}
+
+	cases := []struct {
+		headers      map[string]string
+		code         int
+		upstream     string
+		contentRange string
+		body         string
+	}{
+		{map[string]string{"range": "bytes=2-4"}, 206, "bytes=2-4", "bytes 2-4/10", "234"},
+		{map[string]string{"range": "bytes=2-4", "if-range": `"v1"`}, 200, "", "", "0123456789"},
+		{nil, 200, "", "", "0123456789"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/big.zip", nil)
+		for k, v := range c.headers {
+			r.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		serveAsset(s)(rec, r)
+		if rec.Code != c.code {
+			t.Errorf("%v: got status %d, want %d", c.headers, rec.Code, c.code)
+		}
+		if gotRange != c.upstream {
+			t.Errorf("%v: got upstream range %q, want %q", c.headers, gotRange, c.upstream)
+		}
+		if cr := rec.Header().Get("content-range"); cr != c.contentRange {
+			t.Errorf("%v: got content-range %q, want %q", c.headers, cr, c.contentRange)
+		}
+		if b := rec.Body.String(); b != c.body {
+			t.Errorf("%v: got body %q, want %q", c.headers, b, c.body)
+		}
+		if ar := rec.Header().Get("accept-ranges"); ar != "bytes" {
+			t.Errorf("%v: got accept-ranges %q", c.headers, ar)
+		}
+	}
+}
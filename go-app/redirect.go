@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultRedirects is the redirect map used until the one of the bucket,
+// if any, is loaded.
+//
+//go:embed redirects.json
+var defaultRedirects []byte
+
+// maxRedirectHops is the max number of rules a redirect chain may go
+// through, see RedirectMap.Resolve.
+const maxRedirectHops = 10
+
+// errRedirectLoop is returned for redirect chains which don't terminate.
+var errRedirectLoop = errors.New("redirect loop")
+
+// RedirectMap redirects moved pages, e.g. after restructuring the docs.
+// Rules match URL paths exactly, by prefix or by regular expression, in
+// that order. The longest prefix wins, and regular expressions are tried
+// in order.
+type RedirectMap struct {
+	Rules []*RedirectRule `json:"rules"`
+
+	exact    map[string]*RedirectRule
+	prefixes []*RedirectRule // longest first
+	regexps  []*RedirectRule
+}
+
+// RedirectRule is a rule of a RedirectMap. Exactly one of Path, Prefix or
+// Regexp must be set.
+type RedirectRule struct {
+	Path   string `json:"path,omitempty"`   // URL path, e.g. "/docs/old/"
+	Prefix string `json:"prefix,omitempty"` // URL path prefix, replaced with To
+	Regexp string `json:"regexp,omitempty"` // URL path pattern, To may refer to its groups as $1 or ${name}
+	To     string `json:"to"`               // target URL, absolute or relative to the site
+	Code   int    `json:"code,omitempty"`   // 301, 302, 303, 307 or 308, 301 by default
+
+	re *regexp.Regexp
+}
+
+// LoadRedirects reads the redirect map from the JSON file at path, or
+// the embedded redirects.json if path is empty.
+func LoadRedirects(path string) (*RedirectMap, error) {
+	b := defaultRedirects
+	if path != "" {
+		var err error
+		if b, err = os.ReadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	return ParseRedirects(b)
+}
+
+// ParseRedirects decodes a JSON redirect map and validates it.
+func ParseRedirects(b []byte) (*RedirectMap, error) {
+	var m RedirectMap
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("decode redirect map: %w", err)
+	}
+	m.exact = make(map[string]*RedirectRule)
+	for i, r := range m.Rules {
+		if err := r.init(); err != nil {
+			return nil, fmt.Errorf("redirect map: rule %d: %w", i, err)
+		}
+		switch {
+		case r.Path != "":
+			if m.exact[r.Path] != nil {
+				return nil, fmt.Errorf("redirect map: rule %d: duplicate path %q", i, r.Path)
+			}
+			m.exact[r.Path] = r
+		case r.Prefix != "":
+			m.prefixes = append(m.prefixes, r)
+		default:
+			m.regexps = append(m.regexps, r)
+		}
+	}
+	sort.SliceStable(m.prefixes, func(i, j int) bool {
+		return len(m.prefixes[i].Prefix) > len(m.prefixes[j].Prefix)
+	})
+	// chains starting from regexp rules are only checked when resolved
+	for _, r := range m.Rules {
+		start := r.Path + r.Prefix
+		if start == "" {
+			continue
+		}
+		if _, _, err := m.Resolve(start); err != nil {
+			return nil, fmt.Errorf("redirect map: %w", err)
+		}
+	}
+	return &m, nil
+}
+
+// init validates r and compiles its regexp.
+func (r *RedirectRule) init() error {
+	n := 0
+	for _, v := range []string{r.Path, r.Prefix, r.Regexp} {
+		if v != "" {
+			n++
+		}
+	}
+	if n != 1 {
+		return fmt.Errorf("needs one of path, prefix or regexp")
+	}
+	if (r.Path != "" && !strings.HasPrefix(r.Path, "/")) || (r.Prefix != "" && !strings.HasPrefix(r.Prefix, "/")) {
+		return fmt.Errorf("path %q must start with /", r.Path+r.Prefix)
+	}
+	if r.To == "" {
+		return fmt.Errorf("missing target")
+	}
+	if _, err := url.Parse(r.To); err != nil {
+		return fmt.Errorf("target: %w", err)
+	}
+	switch r.Code {
+	case 0:
+		r.Code = http.StatusMovedPermanently
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return fmt.Errorf("invalid status code %d", r.Code)
+	}
+	if r.Regexp != "" {
+		re, err := regexp.Compile(r.Regexp)
+		if err != nil {
+			return err
+		}
+		r.re = re
+	}
+	return nil
+}
+
+// match returns the target and status code of the rule matching the URL
+// path p, if any. The parts of p copied to the target are escaped.
+func (m *RedirectMap) match(p string) (string, int, bool) {
+	if r := m.exact[p]; r != nil {
+		return r.To, r.Code, true
+	}
+	for _, r := range m.prefixes {
+		if rest, ok := strings.CutPrefix(p, r.Prefix); ok {
+			return r.To + escapePath(rest), r.Code, true
+		}
+	}
+	for _, r := range m.regexps {
+		if sm := r.re.FindStringSubmatchIndex(p); sm != nil {
+			// expand the escaped submatches
+			var src string
+			esc := make([]int, len(sm))
+			for i := 0; i < len(sm); i += 2 {
+				if sm[i] < 0 {
+					esc[i], esc[i+1] = -1, -1
+					continue
+				}
+				esc[i] = len(src)
+				src += escapePath(p[sm[i]:sm[i+1]])
+				esc[i+1] = len(src)
+			}
+			return string(r.re.ExpandString(nil, r.To, src, esc)), r.Code, true
+		}
+	}
+	return "", 0, false
+}
+
+// escapePath escapes the URL path p for use in a redirect target, so that
+// e.g. a "#" or "?" of the path isn't taken for a fragment or query.
+func escapePath(p string) string {
+	return (&url.URL{Path: p}).EscapedPath()
+}
+
+// Resolve returns the URL the URL path p redirects to, with the status
+// code of its first rule, or "" if no rule matches. Chains of rules are
+// followed so that clients are redirected once, and those which loop
+// return an error.
+func (m *RedirectMap) Resolve(p string) (string, int, error) {
+	to, code, ok := m.match(p)
+	if !ok {
+		return "", 0, nil
+	}
+	seen := map[string]bool{p: true}
+	for i := 0; ; i++ {
+		u, err := url.Parse(to)
+		if err != nil || u.Scheme != "" || u.Host != "" {
+			// another site
+			return to, code, nil
+		}
+		if seen[u.Path] || i == maxRedirectHops {
+			return "", 0, fmt.Errorf("%w from %s", errRedirectLoop, p)
+		}
+		seen[u.Path] = true
+		next, _, ok := m.match(u.Path)
+		if !ok {
+			return to, code, nil
+		}
+		to = next
+	}
+}
+
+// Redirects holds the redirect map of the site, reading it from a bucket
+// object when Name is set and reloading it when the object changes.
+// Default is used until then, or when the object is missing.
+type Redirects struct {
+	Default  *RedirectMap // nil uses the embedded redirects.json
+	Bucket   string
+	Name     string        // object name of the redirect map, e.g. "redirects.json"
+	Interval time.Duration // interval of the checks for changes, one minute by default
+
+	m         atomic.Pointer[RedirectMap]
+	once      sync.Once    // loads the redirect map on first use
+	mu        sync.Mutex   // serializes reloads
+	etag      string       // of the loaded object
+	checked   atomic.Int64 // time of the last check, in Unix nanoseconds
+	reloading atomic.Bool
+}
+
+// Resolve resolves the URL path p with the current redirect map, see
+// RedirectMap.Resolve. A nil Redirects redirects nothing.
+func (rs *Redirects) Resolve(ctx context.Context, b Backend, p string) (string, int, error) {
+	if rs == nil {
+		return "", 0, nil
+	}
+	return rs.current(ctx, b).Resolve(p)
+}
+
+// current returns the current redirect map, loading it on first use and
+// checking for changes in the background afterwards.
+func (rs *Redirects) current(ctx context.Context, b Backend) *RedirectMap {
+	rs.once.Do(func() {
+		m := rs.Default
+		if m == nil {
+			var err error
+			if m, err = ParseRedirects(defaultRedirects); err != nil {
+				log.Printf("[ERROR] %v", err)
+				m = &RedirectMap{}
+			}
+		}
+		rs.m.Store(m)
+		if rs.Name != "" {
+			rs.reload(ctx, b)
+		}
+	})
+	if rs.Name != "" && rs.stale() && rs.reloading.CompareAndSwap(false, true) {
+		// the request may complete before the reload
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+		go func() {
+			defer cancel()
+			defer rs.reloading.Store(false)
+			rs.reload(ctx, b)
+		}()
+	}
+	return rs.m.Load()
+}
+
+// stale reports whether the redirect map is due for a check.
+func (rs *Redirects) stale() bool {
+	d := rs.Interval
+	if d <= 0 {
+		d = time.Minute
+	}
+	return time.Since(time.Unix(0, rs.checked.Load())) >= d
+}
+
+// reload loads the redirect map object if it changed since last loaded.
+// Malformed redirect maps are logged and ignored.
+func (rs *Redirects) reload(ctx context.Context, b Backend) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.checked.Store(time.Now().UnixNano())
+	st, err := b.Stat(ctx, rs.Bucket, rs.Name)
+	if err != nil {
+		if !isNotFound(err) {
+			log.Printf("[ERROR] redirect map %s/%s: %v", rs.Bucket, rs.Name, err)
+		}
+		return
+	}
+	if etag := st.Meta["etag"]; etag != "" && etag == rs.etag {
+		return
+	}
+	o, err := b.Open(ctx, rs.Bucket, rs.Name)
+	if err != nil {
+		log.Printf("[ERROR] redirect map %s/%s: %v", rs.Bucket, rs.Name, err)
+		return
+	}
+	defer o.Body.Close()
+	body, err := io.ReadAll(o.Body)
+	if err != nil {
+		log.Printf("[ERROR] redirect map %s/%s: %v", rs.Bucket, rs.Name, err)
+		return
+	}
+	// malformed versions are only reported once
+	rs.etag = o.Meta["etag"]
+	m, err := ParseRedirects(body)
+	if err != nil {
+		log.Printf("[ERROR] %s/%s: %v", rs.Bucket, rs.Name, err)
+		return
+	}
+	rs.m.Store(m)
+	log.Printf("[INFO] loaded %d redirect rules from %s/%s", len(m.Rules), rs.Bucket, rs.Name)
+}
+
+// errOpenRedirect is returned for redirect targets on hosts not allowed
+// by Storage.RedirectHosts.
+var errOpenRedirect = errors.New("redirect to a host not allowed")
+
+// redirectLocation returns the Location of the redirect of r to target.
+// Relative targets, e.g. "../v3/", are resolved against the URL of r, and
+// absolute ones must point to the host of r or to one of hosts, which may
+// be wildcard patterns such as "*.goa.design". The query of r is kept
+// unless target has its own, e.g. for analytics parameters.
+func redirectLocation(r *http.Request, target string, hosts []string) (string, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", fmt.Errorf("redirect %q: %w", target, err)
+	}
+	if u.Scheme != "" || u.Host != "" {
+		if u.Scheme != "" && u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return "", fmt.Errorf("redirect %q: %w", target, errOpenRedirect)
+		}
+		if !redirectHostAllowed(u.Hostname(), r.Host, hosts) {
+			return "", fmt.Errorf("redirect %q: %w", target, errOpenRedirect)
+		}
+	} else {
+		u = r.URL.ResolveReference(u)
+		u.Scheme, u.Host, u.User = "", "", nil
+		// browsers take "/\evil.com" for "//evil.com"
+		if strings.HasPrefix(u.Path, "//") || strings.HasPrefix(u.Path, "/\\") {
+			return "", fmt.Errorf("redirect %q: %w", target, errOpenRedirect)
+		}
+	}
+	if u.RawQuery == "" && !u.ForceQuery {
+		u.RawQuery = r.URL.RawQuery
+	}
+	return u.String(), nil
+}
+
+// redirectHostAllowed reports whether redirects to host are allowed for
+// requests to reqHost.
+func redirectHostAllowed(host, reqHost string, hosts []string) bool {
+	if h, _, err := net.SplitHostPort(reqHost); err == nil {
+		reqHost = h
+	}
+	host = strings.ToLower(host)
+	if host == strings.ToLower(reqHost) {
+		return true
+	}
+	for _, p := range hosts {
+		p = strings.ToLower(p)
+		if host == p {
+			return true
+		}
+		if base, ok := strings.CutPrefix(p, "*."); ok && strings.HasSuffix(host, "."+base) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveRedirect redirects r to target with the status code, see
+// redirectLocation. Invalid targets are answered with 500 Internal Server
+// Error and returned as an error.
+func (s *Storage) serveRedirect(w http.ResponseWriter, r *http.Request, target string, code int) error {
+	loc, err := redirectLocation(r, target, s.RedirectHosts)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return err
+	}
+	w.Header().Set("location", loc)
+	w.WriteHeader(code)
+	return nil
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testRedirects = `{"rules": [
+	{"path": "/docs/old/", "to": "/docs/new/"},
+	{"path": "/docs/gone/", "to": "/docs/old/", "code": 302},
+	{"path": "/slack", "to": "https://gophers.slack.com/messages/goa", "code": 307},
+	{"prefix": "/v2/", "to": "/docs/v2/"},
+	{"prefix": "/v2/design/", "to": "/docs/v2/dsl/", "code": 308},
+	{"regexp": "^/reference/(?P<pkg>[a-z]+)/v1$", "to": "/docs/${pkg}/", "code": 308}
+]}`
+
+func TestParseRedirects(t *testing.T) {
+	if _, err := ParseRedirects([]byte(testRedirects)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseRedirects(defaultRedirects); err != nil {
+		t.Errorf("embedded redirect map: %v", err)
+	}
+	cases := map[string]string{
+		"no matcher":     `{"rules": [{"to": "/a"}]}`,
+		"two matchers":   `{"rules": [{"path": "/a", "prefix": "/b", "to": "/c"}]}`,
+		"relative path":  `{"rules": [{"path": "a", "to": "/b"}]}`,
+		"no target":      `{"rules": [{"path": "/a"}]}`,
+		"invalid code":   `{"rules": [{"path": "/a", "to": "/b", "code": 200}]}`,
+		"invalid regexp": `{"rules": [{"regexp": "(", "to": "/b"}]}`,
+		"duplicate":      `{"rules": [{"path": "/a", "to": "/b"}, {"path": "/a", "to": "/c"}]}`,
+		"self loop":      `{"rules": [{"path": "/a", "to": "/a"}]}`,
+		"loop":           `{"rules": [{"path": "/a", "to": "/b"}, {"path": "/b", "to": "/c"}, {"path": "/c", "to": "/a?x=1"}]}`,
+		"prefix loop":    `{"rules": [{"prefix": "/a/", "to": "/b/"}, {"prefix": "/b/", "to": "/a/"}]}`,
+		"malformed":      `{"rules": {}}`,
+	}
+	for name, c := range cases {
+		if _, err := ParseRedirects([]byte(c)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestRedirectMapResolve(t *testing.T) {
+	m, err := ParseRedirects([]byte(testRedirects))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		path string
+		to   string
+		code int
+	}{
+		{"/docs/old/", "/docs/new/", 301},
+		{"/docs/gone/", "/docs/new/", 302}, // chain
+		{"/slack", "https://gophers.slack.com/messages/goa", 307},
+		{"/v2/intro/", "/docs/v2/intro/", 301},
+		{"/v2/design/types/", "/docs/v2/dsl/types/", 308}, // longest prefix
+		{"/reference/dsl/v1", "/docs/dsl/", 308},
+		{"/reference/dsl/v2", "", 0},
+		{"/docs/new/", "", 0},
+	}
+	for _, c := range cases {
+		to, code, err := m.Resolve(c.path)
+		if err != nil || to != c.to || code != c.code {
+			t.Errorf("%s: got %q %d %v, want %q %d", c.path, to, code, err, c.to, c.code)
+		}
+	}
+
+	// loops through regexps are only detected when resolved
+	m, err = ParseRedirects([]byte(`{"rules": [{"regexp": "^/x/(.*)$", "to": "/x/$1/"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := m.Resolve("/x/a"); !errors.Is(err, errRedirectLoop) {
+		t.Errorf("got %v, want redirect loop", err)
+	}
+}
+
+func TestRedirects(t *testing.T) {
+	ctx := context.Background()
+	mem := &MemBackend{}
+	mem.Put("goa.design", "redirects.json", nil, []byte(`{"rules": [{"path": "/a", "to": "/b"}]}`))
+	rs := &Redirects{Bucket: "goa.design", Name: "redirects.json", Interval: time.Millisecond}
+	resolve := func(p string) string {
+		t.Helper()
+		to, _, err := rs.Resolve(ctx, mem, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return to
+	}
+	reload := func() {
+		t.Helper()
+		time.Sleep(2 * time.Millisecond)
+		resolve("/") // triggers the reload
+		for i := 0; rs.reloading.Load(); i++ {
+			if i == 100 {
+				t.Fatal("reload did not complete")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if to := resolve("/a"); to != "/b" {
+		t.Errorf("got %q, want /b", to)
+	}
+	mem.Put("goa.design", "redirects.json", nil, []byte(`{"rules": [{"path": "/a", "to": "/c"}]}`))
+	reload()
+	if to := resolve("/a"); to != "/c" {
+		t.Errorf("after change: got %q, want /c", to)
+	}
+	// malformed maps are ignored
+	mem.Put("goa.design", "redirects.json", nil, []byte(`{"rules": [{"path": "/a", "to": "/a"}]}`))
+	reload()
+	if to := resolve("/a"); to != "/c" {
+		t.Errorf("after malformed change: got %q, want /c", to)
+	}
+
+	// the default map is used when the object is missing
+	def, _ := ParseRedirects([]byte(`{"rules": [{"path": "/a", "to": "/d"}]}`))
+	rs = &Redirects{Default: def, Bucket: "goa.design", Name: "missing.json"}
+	if to := resolve("/a"); to != "/d" {
+		t.Errorf("missing object: got %q, want /d", to)
+	}
+	var nilRedirects *Redirects
+	if to, _, _ := nilRedirects.Resolve(ctx, mem, "/a"); to != "" {
+		t.Errorf("nil redirects: got %q", to)
+	}
+}
+
+func TestServeAssetRedirects(t *testing.T) {
+	s, _ := newTestStorage()
+	m, err := ParseRedirects([]byte(testRedirects))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Redirects = &Redirects{Default: m}
+	rec := httptest.NewRecorder()
+	serveAsset(s)(rec, httptest.NewRequest("GET", "/v2/design/types/", nil))
+	if rec.Code != 308 || rec.Header().Get("location") != "/docs/v2/dsl/types/" {
+		t.Errorf("got %d to %q, want 308 to /docs/v2/dsl/types/", rec.Code, rec.Header().Get("location"))
+	}
+	// the redirect map takes precedence over objects
+	m, _ = ParseRedirects([]byte(`{"rules": [{"path": "/docs/", "to": "/docs/v3/", "code": 302}]}`))
+	s.Redirects = &Redirects{Default: m}
+	rec = httptest.NewRecorder()
+	serveAsset(s)(rec, httptest.NewRequest("GET", "/docs/", nil))
+	if rec.Code != 302 || rec.Header().Get("location") != "/docs/v3/" {
+		t.Errorf("got %d to %q, want 302 to /docs/v3/", rec.Code, rec.Header().Get("location"))
+	}
+}
+
+func TestServeAssetRedirectEscaping(t *testing.T) {
+	s, mem := newTestStorage()
+	for _, name := range []string{"docs/a#b/index.html", "docs/a%b/index.html", "docs/a?b/index.html"} {
+		mem.Put("goa.design", name, map[string]string{"content-type": "text/html"}, []byte("a"))
+	}
+	m, err := ParseRedirects([]byte(`{"rules": [
+		{"prefix": "/v2/", "to": "/docs/v2/"},
+		{"regexp": "^/reference/(?P<pkg>.+)/v1$", "to": "/docs/${pkg}/", "code": 308}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Redirects = &Redirects{Default: m}
+	cases := []struct {
+		url      string
+		code     int
+		location string
+	}{
+		{"/docs/a%23b", 301, "/docs/a%23b/"},
+		{"/docs/a%25b", 301, "/docs/a%25b/"},
+		{"/docs/a%3Fb", 301, "/docs/a%3Fb/"},
+		{"/v2/a%23b", 301, "/docs/v2/a%23b"},
+		{"/v2/a%25b?v=1", 301, "/docs/v2/a%25b?v=1"},
+		{"/v2/a%3Fb", 301, "/docs/v2/a%3Fb"},
+		{"/reference/a%23b/v1", 308, "/docs/a%23b/"},
+		{"/reference/a%25b/v1", 308, "/docs/a%25b/"},
+		{"/reference/a%3Fb/v1", 308, "/docs/a%3Fb/"},
+		{"/ja/docs/a%23b", 302, "/docs/a%23b"},
+		{"/ja/docs/a%25b", 302, "/docs/a%25b"},
+		{"/ja/docs/a%3Fb", 302, "/docs/a%3Fb"},
+	}
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		serveAsset(s)(rec, httptest.NewRequest("GET", c.url, nil))
+		if rec.Code != c.code || rec.Header().Get("location") != c.location {
+			t.Errorf("%s: got %d to %q, want %d to %q", c.url, rec.Code, rec.Header().Get("location"), c.code, c.location)
+		}
+	}
+}
+
+func TestRedirectLocation(t *testing.T) {
+	hosts := []string{"github.com", "*.goa.design"}
+	cases := []struct {
+		url, target string
+		want        string
+		err         bool
+	}{
+		{"/docs", "/docs/", "/docs/", false},
+		{"/docs?go-get=1", "/docs/", "/docs/?go-get=1", false},
+		{"/docs?utm_source=x&v=1", "/docs/#intro", "/docs/?utm_source=x&v=1#intro", false},
+		{"/old?a=1", "/new/?b=2", "/new/?b=2", false},
+		{"/old?a=1", "/new/?", "/new/?", false},
+		{"/docs/v2/intro", "../v3/intro", "/docs/v3/intro", false},
+		{"/docs/v2/", "dsl/", "/docs/v2/dsl/", false},
+		{"/x?q=1", "https://github.com/goadesign/goa", "https://github.com/goadesign/goa?q=1", false},
+		{"/x", "https://v2.goa.design/docs/", "https://v2.goa.design/docs/", false},
+		{"/x", "https://goa.design/docs/", "https://goa.design/docs/", false}, // requested host
+		{"/x", "https://evil.com/", "", true},
+		{"/x", "//evil.com/", "", true},
+		{"/x", "https://goa.design.evil.com/", "", true},
+		{"/x", "https://evilgoa.design/", "", true},
+		{"/x", "/\\evil.com/", "", true},
+		{"/x", "javascript:alert(1)", "", true},
+		{"/x", "https:evil.com", "", true},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "https://goa.design:443"+c.url, nil)
+		got, err := redirectLocation(r, c.target, hosts)
+		if c.err {
+			if !errors.Is(err, errOpenRedirect) {
+				t.Errorf("%s to %s: got %q, %v, want open redirect error", c.url, c.target, got, err)
+			}
+			continue
+		}
+		if err != nil || got != c.want {
+			t.Errorf("%s to %s: got %q, %v, want %q", c.url, c.target, got, err, c.want)
+		}
+	}
+}
+
+func TestServeObjectRedirect(t *testing.T) {
+	s, _ := newTestStorage()
+	s.RedirectHosts = []string{"github.com"}
+	cases := []struct {
+		url      string
+		code     int
+		location string
+	}{
+		{"/docs?v=1", 301, "/docs/?v=1"},
+		{"/old?v=1", 302, "/new/?v=1"},
+		{"/moved/", 500, ""}, // example.com is not allowed
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "https://goa.design"+c.url, nil)
+		rec := httptest.NewRecorder()
+		serveAsset(s)(rec, r)
+		if rec.Code != c.code || rec.Header().Get("location") != c.location {
+			t.Errorf("%s: got %d to %q, want %d to %q", c.url, rec.Code, rec.Header().Get("location"), c.code, c.location)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// DefaultSecurityHeaders is the SecurityHeaders of the app unless
+// SECURITY_CONFIG is set. Its content security policy only restricts what
+// doesn't depend on the site pages.
+var DefaultSecurityHeaders = &SecurityHeaders{
+	Host:              "goa.design",
+	HSTS:              "max-age=31536000",
+	CSP:               "object-src 'none'; base-uri 'self'; frame-ancestors 'self'",
+	PackageCSP:        "default-src 'none'; base-uri 'none'; frame-ancestors 'none'",
+	ReferrerPolicy:    "strict-origin-when-cross-origin",
+	PermissionsPolicy: "camera=(), microphone=(), geolocation=()",
+}
+
+// SecurityHeaders configures the security headers added to responses by
+// withSecurityHeaders. Responses also get X-Content-Type-Options: nosniff.
+type SecurityHeaders struct {
+	// Host is the host plain HTTP requests are redirected to, see
+	// RedirectHTTPS.
+	Host string `json:"host"`
+	// HSTS is the Strict-Transport-Security header of HTTPS responses,
+	// e.g. "max-age=31536000; includeSubDomains".
+	HSTS string `json:"hsts"`
+	// CSP is the Content-Security-Policy header.
+	CSP string `json:"csp"`
+	// Paths overrides CSP for URL paths starting with the keys, e.g.
+	// "/docs/". The longest matching prefix wins, and an empty policy
+	// disables the header.
+	Paths map[string]string `json:"paths"`
+	// PackageCSP is the CSP of the vanity import pages of modules.
+	PackageCSP string `json:"packageCsp"`
+	// ReportOnly sends the policy as Content-Security-Policy-Report-Only,
+	// e.g. to try a policy out with a report-uri directive.
+	ReportOnly bool `json:"reportOnly"`
+	// ReferrerPolicy is the Referrer-Policy header.
+	ReferrerPolicy string `json:"referrerPolicy"`
+	// PermissionsPolicy is the Permissions-Policy header.
+	PermissionsPolicy string `json:"permissionsPolicy"`
+	// RedirectHTTPS redirects plain HTTP requests to HTTPS on Host, except
+	// those of the App Engine internal endpoints under /_ah/.
+	RedirectHTTPS bool `json:"redirectHttps"`
+}
+
+// LoadSecurityHeaders reads SecurityHeaders from the JSON file at path.
+func LoadSecurityHeaders(path string) (*SecurityHeaders, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var sh SecurityHeaders
+	if err := json.Unmarshal(b, &sh); err != nil {
+		return nil, fmt.Errorf("decode security headers: %w", err)
+	}
+	for p := range sh.Paths {
+		if !strings.HasPrefix(p, "/") {
+			return nil, fmt.Errorf("security headers: path %q must start with /", p)
+		}
+	}
+	if sh.RedirectHTTPS && sh.Host == "" {
+		return nil, fmt.Errorf("security headers: HTTPS redirects require a host")
+	}
+	return &sh, nil
+}
+
+// packages returns the SecurityHeaders of the vanity import pages.
+func (sh *SecurityHeaders) packages() *SecurityHeaders {
+	c := *sh
+	c.CSP, c.Paths = sh.PackageCSP, nil
+	return &c
+}
+
+// policy returns the CSP applying to the URL path p.
+func (sh *SecurityHeaders) policy(p string) string {
+	best, n := sh.CSP, -1
+	for prefix, csp := range sh.Paths {
+		if strings.HasPrefix(p, prefix) && len(prefix) > n {
+			best, n = csp, len(prefix)
+		}
+	}
+	return best
+}
+
+// isHTTPS reports whether r was received over HTTPS, directly or through
+// a front end setting X-Forwarded-Proto, see Platform.ForwardedProto.
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || platform.ForwardedProto && r.Header.Get("x-forwarded-proto") == "https"
+}
+
+// withSecurityHeaders adds the security headers configured by sh to the
+// responses of next.
+func withSecurityHeaders(sh *SecurityHeaders, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if sh.RedirectHTTPS && sh.Host != "" && !isHTTPS(r) && !strings.HasPrefix(r.URL.Path, "/_ah/") {
+			code := http.StatusPermanentRedirect
+			if r.Method == "GET" || r.Method == "HEAD" {
+				code = http.StatusMovedPermanently
+			}
+			// the request host is client-supplied
+			http.Redirect(w, r, "https://"+sh.Host+r.URL.RequestURI(), code)
+			return
+		}
+		h := w.Header()
+		h.Set("x-content-type-options", "nosniff")
+		if sh.HSTS != "" && isHTTPS(r) {
+			h.Set("strict-transport-security", sh.HSTS)
+		}
+		if sh.ReferrerPolicy != "" {
+			h.Set("referrer-policy", sh.ReferrerPolicy)
+		}
+		if sh.PermissionsPolicy != "" {
+			h.Set("permissions-policy", sh.PermissionsPolicy)
+		}
+		if csp := sh.policy(r.URL.Path); csp != "" {
+			name := "content-security-policy"
+			if sh.ReportOnly {
+				name = "content-security-policy-report-only"
+			}
+			h.Set(name, csp)
+		}
+		next(w, r)
+	}
+}
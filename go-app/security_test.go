@@ -0,0 +1,170 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// trustForwardedProto makes the tests run on a platform setting
+// X-Forwarded-Proto.
+func trustForwardedProto(t *testing.T) {
+	old := platform
+	p := *old
+	p.ForwardedProto = true
+	platform = &p
+	t.Cleanup(func() { platform = old })
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	trustForwardedProto(t)
+	sh := &SecurityHeaders{
+		HSTS: "max-age=60",
+		CSP:  "default-src 'self'",
+		Paths: map[string]string{
+			"/docs/":      "default-src 'self'; script-src 'self'",
+			"/docs/demo/": "",
+		},
+		ReferrerPolicy:    "no-referrer",
+		PermissionsPolicy: "camera=()",
+	}
+	h := withSecurityHeaders(sh, func(w http.ResponseWriter, r *http.Request) {})
+	serve := func(path string, https bool) http.Header {
+		t.Helper()
+		r := httptest.NewRequest("GET", path, nil)
+		if https {
+			r.Header.Set("x-forwarded-proto", "https")
+		}
+		rec := httptest.NewRecorder()
+		h(rec, r)
+		if rec.Code != 200 {
+			t.Errorf("%s: got status %d", path, rec.Code)
+		}
+		return rec.Header()
+	}
+
+	hdr := serve("/", true)
+	want := map[string]string{
+		"strict-transport-security": "max-age=60",
+		"content-security-policy":   "default-src 'self'",
+		"x-content-type-options":    "nosniff",
+		"referrer-policy":           "no-referrer",
+		"permissions-policy":        "camera=()",
+	}
+	for k, v := range want {
+		if got := hdr.Get(k); got != v {
+			t.Errorf("%s: got %q, want %q", k, got, v)
+		}
+	}
+	if hdr := serve("/", false); hdr.Get("strict-transport-security") != "" {
+		t.Error("HSTS sent over plain HTTP")
+	}
+
+	// per-path policies
+	if hdr := serve("/docs/intro/", true); hdr.Get("content-security-policy") != "default-src 'self'; script-src 'self'" {
+		t.Errorf("/docs/ policy: got %q", hdr.Get("content-security-policy"))
+	}
+	if hdr := serve("/docs/demo/", true); hdr.Get("content-security-policy") != "" {
+		t.Errorf("disabled policy: got %q", hdr.Get("content-security-policy"))
+	}
+
+	// report only
+	sh.ReportOnly = true
+	hdr = serve("/", true)
+	if hdr.Get("content-security-policy") != "" || hdr.Get("content-security-policy-report-only") != "default-src 'self'" {
+		t.Errorf("report only: got %v", hdr)
+	}
+}
+
+func TestSecurityHeadersRedirectHTTPS(t *testing.T) {
+	trustForwardedProto(t)
+	h := withSecurityHeaders(&SecurityHeaders{Host: "goa.design", RedirectHTTPS: true}, func(w http.ResponseWriter, r *http.Request) {})
+	cases := []struct {
+		method, url string
+		https       bool
+		code        int
+		location    string
+	}{
+		{"GET", "http://goa.design/docs/?v=1", false, 301, "https://goa.design/docs/?v=1"},
+		{"POST", "http://goa.design/_admin/purge", false, 308, "https://goa.design/_admin/purge"},
+		{"GET", "http://goa.design/docs/", true, 200, ""},
+		{"GET", "http://goa.design/_ah/warmup", false, 200, ""},
+		{"GET", "http://evil.com/docs/", false, 301, "https://goa.design/docs/"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, c.url, nil)
+		if c.https {
+			r.Header.Set("x-forwarded-proto", "https")
+		}
+		rec := httptest.NewRecorder()
+		h(rec, r)
+		if rec.Code != c.code || rec.Header().Get("location") != c.location {
+			t.Errorf("%s %s: got %d to %q, want %d to %q", c.method, c.url, rec.Code, rec.Header().Get("location"), c.code, c.location)
+		}
+	}
+
+	// clients can't forge X-Forwarded-Proto on other platforms
+	platform.ForwardedProto = false
+	r := httptest.NewRequest("GET", "http://goa.design/docs/", nil)
+	r.Header.Set("x-forwarded-proto", "https")
+	rec := httptest.NewRecorder()
+	h(rec, r)
+	if rec.Code != 301 || rec.Header().Get("strict-transport-security") != "" {
+		t.Errorf("forged X-Forwarded-Proto: got %d with HSTS %q", rec.Code, rec.Header().Get("strict-transport-security"))
+	}
+}
+
+func TestLoadSecurityHeaders(t *testing.T) {
+	dir := t.TempDir()
+	write := func(s string) string {
+		p := filepath.Join(dir, "security.json")
+		if err := os.WriteFile(p, []byte(s), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	sh, err := LoadSecurityHeaders(write(`{"host": "goa.design", "csp": "default-src 'self'", "paths": {"/docs/": ""}, "reportOnly": true, "redirectHttps": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sh.CSP != "default-src 'self'" || !sh.ReportOnly || !sh.RedirectHTTPS || sh.policy("/docs/") != "" {
+		t.Errorf("got %+v", sh)
+	}
+	if _, err := LoadSecurityHeaders(write(`{"paths": {"docs/": ""}}`)); err == nil {
+		t.Error("relative path: expected error")
+	}
+	if _, err := LoadSecurityHeaders(write(`{"redirectHttps": true}`)); err == nil {
+		t.Error("HTTPS redirect without host: expected error")
+	}
+}
+
+func TestServePackagePolicy(t *testing.T) {
+	reg, err := LoadRegistry("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := withSecurityHeaders(DefaultSecurityHeaders.packages(), servePackage(reg))
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest("GET", "/"+reg.Modules[0].Path+"?go-get=1", nil))
+	if csp := rec.Header().Get("content-security-policy"); csp != DefaultSecurityHeaders.PackageCSP {
+		t.Errorf("got policy %q, want %q", csp, DefaultSecurityHeaders.PackageCSP)
+	}
+	if body := rec.Body.String(); strings.Contains(body, "<style") || strings.Contains(body, "<script") {
+		t.Errorf("import page is not meta only:\n%s", body)
+	}
+}
+
+func TestServeObjectCustomMeta(t *testing.T) {
+	s, mem := newTestStorage()
+	mem.Put("goa.design", "tagged.css", map[string]string{"content-type": "text/css", metaCacheTags: "docs"}, []byte("p{}"))
+	rec := httptest.NewRecorder()
+	serveAsset(s)(rec, httptest.NewRequest("GET", "/tagged.css", nil))
+	for k := range rec.Header() {
+		if strings.HasPrefix(strings.ToLower(k), "x-goog-meta-") {
+			t.Errorf("custom metadata %s exposed", k)
+		}
+	}
+}
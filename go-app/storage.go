@@ -3,50 +3,130 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/gob"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
-	"net/http"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"time"
-
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
-	"google.golang.org/appengine/v2"
-	"google.golang.org/appengine/v2/memcache"
-	"google.golang.org/appengine/v2/urlfetch"
 )
 
-// Google Cloud Storage OAuth2 scopes.
-const scopeStorageRead = "https://www.googleapis.com/auth/devstorage.read_only"
-
 // DefaultStorage is a Storage with sensible default parameters.
 var DefaultStorage = &Storage{
-	Base:  "https://storage.googleapis.com",
-	Index: "index.html",
+	Backend: &GCSBackend{Base: "https://storage.googleapis.com"},
+	Index:   "index.html",
+	Cache:   newMemcache(),
+	MaxAge:  time.Hour,
+
+	StaleWhileRevalidate: time.Hour,
+	StaleIfError:         24 * time.Hour,
+	IndexTimeout:         5 * time.Second,
+	RedirectHosts:        []string{"goa.design", "*.goa.design", "github.com", "pkg.go.dev"},
 	CORS: CORS{
-		Origin: []string{"*"},
-		MaxAge: "86400",
+		Origin:  []string{"*"},
+		Headers: []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since"},
+		Expose:  []string{"Location", "Etag", "Content-Disposition", "Content-Range"},
+		MaxAge:  "86400",
 	},
 }
 
-// CORS is a Storage cross-origin settings.
-type CORS struct {
-	Origin []string // allowed origins
-	MaxAge string   // preflight cache, in seconds
+// Storage incapsulates configuration params for retrieveing and serving objects.
+type Storage struct {
+	Backend Backend // Object store, e.g. GCS.
+	Index   string  // Appended to an object name in certain cases, e.g. "index.html".
+	CORS    CORS    // Cross-origin policy, see LoadCORS.
+	Cache   Cache   // Caches retrieved objects, nil disables caching.
+
+	// Redirects redirects moved pages before they are looked up, nil
+	// disables the redirect map. Objects may redirect too, see
+	// Object.Redirect.
+	Redirects *Redirects
+	// RedirectHosts lists the hosts redirects may point to besides the
+	// requested one, e.g. "github.com" or "*.goa.design".
+	RedirectHosts []string
+
+	// MaxAge is the duration cached objects are considered fresh for.
+	// Stale objects are revalidated against the backend, with a
+	// conditional request when the backend supports it.
+	// Zero means cached objects never go stale.
+	MaxAge time.Duration
+
+	// StaleWhileRevalidate is the duration past MaxAge during which
+	// stale objects are served while being revalidated in the
+	// background. Older objects are revalidated before being served.
+	StaleWhileRevalidate time.Duration
+
+	// StaleIfError is the duration past MaxAge during which stale
+	// objects are served when the backend fails to revalidate them,
+	// e.g. with a 5xx response or a timeout.
+	StaleIfError time.Duration
+
+	// IndexTimeout bounds the wait for the Index object of a directory
+	// requested without a trailing slash, once the object named after the
+	// directory is found missing, see OpenFile. Zero waits as long as the
+	// context allows.
+	IndexTimeout time.Duration
+
+	refreshing sync.Map // cache keys being revalidated in the background
+
+	mu      sync.Mutex
+	flights map[string]*flight // backend fetches in progress, by cache key
+}
+
+const (
+	// fetchTimeout bounds shared backend fetches, which outlive the
+	// requests waiting for them.
+	fetchTimeout = 30 * time.Second
+	// fetchLeaseTTL is the expiration of the lease an instance holds on
+	// a cache key while fetching its object.
+	fetchLeaseTTL = 10 * time.Second
+	// fetchLeaseWait is how long instances wait for the lease holder to
+	// cache the object before fetching it themselves.
+	fetchLeaseWait = 3 * time.Second
+	// fetchLeasePoll is the interval the cache is polled at meanwhile.
+	fetchLeasePoll = 100 * time.Millisecond
+	// fetchLeaseSuffix is appended to cache keys to form the key of
+	// their fetch lease.
+	fetchLeaseSuffix = "#lease"
+)
+
+// flight is a backend fetch shared by the requests of a cache key.
+type flight struct {
+	done  chan struct{} // closed once the fetch completes
+	buf   *objectBuf    // the object, nil if too large to share
+	large *Object       // the object too large to share, for the request which started the fetch
+	gone  bool          // the request which started the fetch gave up, guarded by Storage.mu
+	err   error
 }
 
-// Storage incapsulates configuration params for retrieveing and serving GCS objects.
-type Storage struct {
-	Base  string // GCS service base URL, e.g. "https://storage.googleapis.com".
-	Index string // Appended to an object name in certain cases, e.g. "index.html".
-	CORS  CORS
+// fetchBody is the Body of an object fetched with a context of its own,
+// released once the body is closed.
+type fetchBody struct {
+	io.Reader
+	body    io.Closer
+	release func()
+}
+
+// Close implements io.Closer.
+func (b *fetchBody) Close() error {
+	err := b.body.Close()
+	b.release()
+	return err
 }
 
 // OpenFile abstracts Open and treats object name like a file path.
+// Names without an extension, such as "docs", which are not found
+// are redirected to "docs/" if "docs/index.html" exists.
 func (s *Storage) OpenFile(ctx context.Context, bucket, name string) (*Object, error) {
+	return s.OpenFileRange(ctx, bucket, name, "")
+}
+
+// OpenFileRange is like OpenFile but uses OpenRange to retrieve the object.
+func (s *Storage) OpenFileRange(ctx context.Context, bucket, name, rng string) (*Object, error) {
 	if name == "" || strings.HasSuffix(name, "/") {
 		name += s.Index
 	}
@@ -59,33 +139,39 @@ func (s *Storage) OpenFile(ctx context.Context, bucket, name string) (*Object, e
 	}
 	var ch chan *stat
 	if checkStat {
+		// the stat is abandoned when the object itself is found
+		sctx, cancel := context.WithCancel(ctx)
+		defer cancel()
 		ch = make(chan *stat, 1)
 		go func() {
-			o, err := s.Stat(ctx, bucket, path.Join(name, s.Index))
+			o, err := s.Stat(sctx, bucket, path.Join(name, s.Index))
 			ch <- &stat{o, err}
-			close(ch)
 		}()
 	}
 
 	// try the original object meanwhile
-	o, err := s.Open(ctx, bucket, name)
+	o, err := s.OpenRange(ctx, bucket, name, rng)
 	if err == nil || !checkStat {
 		return o, err
 	}
 	// Return non-404 errors right away, even when checkStat == true.
-	// Note that GCS now may respond with 403 Forbidden
-	// for nonexistent objects.
-	if ferr, ok := err.(*FetchError); ok && ferr.Code != 404 && ferr.Code != 403 {
+	if !isNotFound(err) {
 		return nil, err
 	}
 
-	// wait some time for stat obj
-	// TODO: use ctxhttp
+	var timeout <-chan time.Time
+	if s.IndexTimeout > 0 {
+		t := time.NewTimer(s.IndexTimeout)
+		defer t.Stop()
+		timeout = t.C
+	}
 	select {
-	case <-time.After(5 * time.Second):
-		log.Printf("[ERROR] s.Stat(bucket=%q) timeout", bucket)
+	case <-timeout:
+		log.Printf("[ERROR] s.Stat(%q, %q): timeout", bucket, path.Join(name, s.Index))
 		// return original Open error
 		return nil, err
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	case res := <-ch:
 		if res.err != nil {
 			// return original Open error
@@ -93,151 +179,479 @@ func (s *Storage) OpenFile(ctx context.Context, bucket, name string) (*Object, e
 		}
 		o = res.o
 	}
+	if o.Body == nil {
+		o.Body = newBytesBody(nil)
+	}
 	if o.Redirect() == "" {
 		o = &Object{
-			Body: ioutil.NopCloser(bytes.NewReader(nil)),
+			Body: newBytesBody(nil),
 			Meta: map[string]string{
-				metaRedirect: path.Join("/", name) + "/",
+				metaRedirect: escapePath(path.Join("/", name) + "/"),
 			},
 		}
 	}
 	return o, nil
 }
 
-// Open retrieves GCS object name of the bucket from cache or network.
-// Objects fetched from the network are cached before returning
-// from this function.
+// Open retrieves object name of the bucket from cache or s.Backend.
+// Objects retrieved from the backend are cached once their body
+// is read in full.
 func (s *Storage) Open(ctx context.Context, bucket, name string) (*Object, error) {
-	key := s.CacheKey(ctx, bucket, name)
-	o, err := getCache(ctx, key)
+	return s.OpenRange(ctx, bucket, name, "")
+}
+
+// OpenRange is like Open but retrieves only the byte range rng, a Range
+// header value such as "bytes=0-99", when the object is not cached and
+// s.Backend implements RangeBackend. Such partial objects have a
+// content-range Meta and are not cached. An empty rng retrieves the whole
+// object.
+func (s *Storage) OpenRange(ctx context.Context, bucket, name, rng string) (*Object, error) {
+	o, err := s.openRange(ctx, bucket, name, rng)
 	if err != nil {
-		u := fmt.Sprintf("%s/%s", s.Base, path.Join(bucket, name))
-		o, err = fetch(ctx, u, key)
+		return nil, err
 	}
-	return o, err
+	o.Name = name
+	return o, nil
 }
 
-// Stat is similar to Read except the returned Object.Body may be nil.
-// In the case where Body is not nil, calling Body.Close() is not required.
-func (s *Storage) Stat(ctx context.Context, bucket, name string) (*Object, error) {
-	if o, err := getCache(ctx, s.CacheKey(ctx, bucket, name)); err == nil {
-		return o, nil
+func (s *Storage) openRange(ctx context.Context, bucket, name, rng string) (*Object, error) {
+	rb, ok := s.Backend.(RangeBackend)
+	if !ok {
+		rng = ""
 	}
-	u := fmt.Sprintf("%s/%s", s.Base, path.Join(bucket, name))
-	req, err := http.NewRequest("HEAD", u, nil)
+	if s.Cache == nil {
+		if rng != "" {
+			return rb.OpenRange(ctx, bucket, name, rng)
+		}
+		return s.Backend.Open(ctx, bucket, name)
+	}
+	key := s.CacheKey(ctx, bucket, name)
+	b, err := getCache(ctx, s.Cache, key)
+	if err == nil {
+		age := time.Since(b.Fetched)
+		switch {
+		case s.MaxAge == 0 || age < s.MaxAge:
+			return b.object(), nil
+		case age < s.MaxAge+s.StaleWhileRevalidate:
+			s.refresh(ctx, bucket, name, b)
+			return b.object(), nil
+		}
+		return s.revalidate(ctx, bucket, name, b)
+	}
+	if rng != "" {
+		return rb.OpenRange(ctx, bucket, name, rng)
+	}
+	return s.fetch(ctx, bucket, name, key)
+}
+
+// fetch retrieves object name of the bucket from s.Backend and caches it
+// under key. Concurrent fetches of a key share a single backend request,
+// e.g. right after a deploy flushed the cache, and so do the instances
+// sharing s.Cache, see fetchShared. Objects too large to be cached are
+// streamed to the request which started the fetch, and retrieved by each
+// of the others.
+func (s *Storage) fetch(ctx context.Context, bucket, name, key string) (*Object, error) {
+	s.mu.Lock()
+	f, ok := s.flights[key]
+	started := !ok
+	if started {
+		if s.flights == nil {
+			s.flights = make(map[string]*flight)
+		}
+		f = &flight{done: make(chan struct{})}
+		s.flights[key] = f
+		// the requests may complete before the fetch
+		fctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		timeout := time.AfterFunc(fetchTimeout, cancel)
+		go func() {
+			buf, large, err := s.fetchShared(fctx, bucket, name, key)
+			s.mu.Lock()
+			f.buf, f.err = buf, err
+			delete(s.flights, key)
+			if large != nil && !f.gone && timeout.Stop() {
+				// read within the deadline of the request
+				stop := context.AfterFunc(ctx, cancel)
+				large.Body = &fetchBody{Reader: large.Body, body: large.Body, release: func() {
+					stop()
+					cancel()
+				}}
+				f.large = large
+			} else {
+				if large != nil {
+					large.Body.Close()
+				}
+				cancel()
+			}
+			s.mu.Unlock()
+			close(f.done)
+		}()
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		if started {
+			s.mu.Lock()
+			f.gone = true
+			if f.large != nil {
+				f.large.Body.Close()
+				f.large = nil
+			}
+			s.mu.Unlock()
+		}
+		return nil, ctx.Err()
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	if f.buf != nil {
+		return f.buf.object(), nil
+	}
+	if started && f.large != nil {
+		return f.large, nil
+	}
+	o, err := s.Backend.Open(ctx, bucket, name)
 	if err != nil {
 		return nil, err
 	}
-	res, err := httpClient(ctx, scopeStorageRead).Do(req)
+	return s.cacheObject(ctx, key, o), nil
+}
+
+// fetchShared reads object name of the bucket in full and caches it under
+// key, unless it is too large to be cached, in which case it returns the
+// object as retrieved, with the part already read buffered. Only the
+// instance holding the fetch lease of key requests the object from
+// s.Backend. The others wait for it to be cached, for up to fetchLeaseWait.
+func (s *Storage) fetchShared(ctx context.Context, bucket, name, key string) (*objectBuf, *Object, error) {
+	lease := key + fetchLeaseSuffix
+	deadline := time.Now().Add(fetchLeaseWait)
+	for !acquireLease(ctx, s.Cache, lease, fetchLeaseTTL) {
+		if time.Now().After(deadline) {
+			log.Printf("[ERROR] fetch %s/%s: lease wait timeout", bucket, name)
+			lease = ""
+			break
+		}
+		select {
+		case <-time.After(fetchLeasePoll):
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+		if b, err := getCache(ctx, s.Cache, key); err == nil {
+			return b, nil, nil
+		}
+	}
+	if lease != "" {
+		defer s.Cache.Delete(ctx, lease)
+	}
+
+	o, err := s.Backend.Open(ctx, bucket, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if o.Size >= cacheObjectMax {
+		return nil, o, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(o.Body, cacheObjectMax))
 	if err != nil {
+		o.Body.Close()
+		return nil, nil, err
+	}
+	if len(body) >= cacheObjectMax {
+		// of unknown size
+		o.Body = &fetchBody{
+			Reader:  io.MultiReader(bytes.NewReader(body), o.Body),
+			body:    o.Body,
+			release: func() {},
+		}
+		return nil, o, nil
+	}
+	o.Body.Close()
+	b := &objectBuf{
+		Meta:    o.Meta,
+		Body:    body,
+		Fetched: time.Now(),
+		key:     key,
+		expiry:  s.cacheExpiry(),
+	}
+	setCache(ctx, s.Cache, b)
+	return b, nil, nil
+}
+
+// revalidate checks whether the stale cached object b of the bucket
+// is still current and returns it if so, or the backend object otherwise.
+// The cached object is also returned when the backend fails to respond,
+// within the StaleIfError window.
+func (s *Storage) revalidate(ctx context.Context, bucket, name string, b *objectBuf) (*Object, error) {
+	var (
+		o   *Object
+		err error
+	)
+	if cb, ok := s.Backend.(ConditionalBackend); ok && b.Meta["etag"] != "" {
+		o, err = cb.OpenIfNoneMatch(ctx, bucket, name, b.Meta["etag"])
+	} else {
+		o, err = s.Backend.Open(ctx, bucket, name)
+	}
+	switch {
+	case err == ErrNotModified:
+		b.Fetched = time.Now()
+		b.expiry = s.cacheExpiry()
+		setCache(ctx, s.Cache, b)
+		return b.object(), nil
+	case err == nil:
+		return s.cacheObject(ctx, b.key, o), nil
+	}
+	if ferr, ok := err.(*FetchError); isNotFound(err) || ok && ferr.Code == 410 {
+		// the object is gone
+		s.Cache.Delete(ctx, b.key)
 		return nil, err
 	}
-	defer res.Body.Close()
-	if res.StatusCode != http.StatusOK {
-		b, _ := ioutil.ReadAll(res.Body)
-		return nil, &FetchError{
-			Msg:  fmt.Sprintf("%s: %s", res.Status, b),
-			Code: res.StatusCode,
+	if time.Since(b.Fetched) >= s.MaxAge+s.StaleIfError {
+		return nil, err
+	}
+	log.Printf("[ERROR] revalidate %s/%s: %v, serving stale object", bucket, name, err)
+	return b.object(), nil
+}
+
+// refresh revalidates the stale cached object b of the bucket in the
+// background, unless it is already being revalidated.
+func (s *Storage) refresh(ctx context.Context, bucket, name string, b *objectBuf) {
+	if _, busy := s.refreshing.LoadOrStore(b.key, true); busy {
+		return
+	}
+	// the request may complete before the revalidation
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+	go func() {
+		defer cancel()
+		defer s.refreshing.Delete(b.key)
+		o, err := s.revalidate(ctx, bucket, name, b)
+		if err != nil {
+			return
 		}
+		// cache the new object
+		io.Copy(io.Discard, o.Body)
+		o.Body.Close()
+	}()
+}
+
+// cacheExpiry returns the expiration of cache items, long enough for
+// stale objects to be served within the StaleWhileRevalidate and
+// StaleIfError windows.
+func (s *Storage) cacheExpiry() time.Duration {
+	if s.MaxAge == 0 {
+		return cacheItemExpiry
 	}
-	meta := make(map[string]string)
-	for _, k := range objectHeaders {
-		if v := res.Header.Get(k); v != "" {
-			meta[k] = v
+	return max(cacheItemExpiry, s.MaxAge+max(s.StaleWhileRevalidate, s.StaleIfError))
+}
+
+// cacheObject arranges for o to be cached under key once its body is read
+// in full, provided it is small enough.
+func (s *Storage) cacheObject(ctx context.Context, key string, o *Object) *Object {
+	if o.Size < cacheObjectMax {
+		o.Body = &objectBuf{
+			Meta:    o.Meta,
+			Fetched: time.Now(),
+			r:       o.Body,
+			cache:   s.Cache,
+			key:     key,
+			expiry:  s.cacheExpiry(),
+			ctx:     ctx,
+		}
+	}
+	return o
+}
+
+// Stat is similar to Read except the returned Object.Body may be nil.
+// In the case where Body is not nil, calling Body.Close() is not required.
+func (s *Storage) Stat(ctx context.Context, bucket, name string) (*Object, error) {
+	if s.Cache != nil {
+		if b, err := getCache(ctx, s.Cache, s.CacheKey(ctx, bucket, name)); err == nil {
+			return b.object(), nil
 		}
 	}
-	return &Object{Meta: meta}, nil
+	return s.Backend.Stat(ctx, bucket, name)
+}
+
+// List returns the names of the objects of the bucket starting with prefix.
+func (s *Storage) List(ctx context.Context, bucket, prefix string) ([]string, error) {
+	return s.Backend.List(ctx, bucket, prefix)
 }
 
-// PurgeCache removes cached object from memcache.
-// It does not return an error in the case of cache miss.
+// PurgeCache removes cached object from s.Cache, along with its encoded
+// variants. It does not return an error in the case of cache miss.
 func (s *Storage) PurgeCache(ctx context.Context, bucket, name string) error {
-	return purgeCache(ctx, s.CacheKey(ctx, bucket, name))
+	return s.deleteCache(ctx, s.cacheKeys(ctx, bucket, name))
 }
 
-// CacheKey returns a key to cache an object under, computed from
-// s.Base, bucket and then name.
-func (s *Storage) CacheKey(ctx context.Context, bucket, name string) string {
-	// VersionID is stable for the lifetime of a deployed version and changes on each deployment.
-	// It ensures cached objects do not bleed across versions.
-	return fmt.Sprintf("%s/%s/%s", appengine.VersionID(ctx), s.Base, path.Join(bucket, name))
+// PurgeObject removes object name from s.Cache under all the names it is
+// served as: "docs/index.html" is also cached as "docs/" and "docs".
+func (s *Storage) PurgeObject(ctx context.Context, bucket, name string) error {
+	return s.deleteCache(ctx, s.objectKeys(ctx, bucket, name))
 }
 
-// fetch retrieves object from the given url.
-// The returned error will be of type FetchError if the storage responds
-// with an error code.
-//
-// The returned Object.Body will auto-cache in memcache if cacheKey
-// is provided and body length is within allowed cache limits.
-func fetch(ctx context.Context, url, cacheKey string) (*Object, error) {
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
+// PurgeQuery selects the cached objects removed by Storage.Purge.
+type PurgeQuery struct {
+	Prefix  string   `json:"prefix"`  // object name prefix, e.g. "docs/ja/"
+	Objects []string `json:"objects"` // object names, purged as with PurgeObject
+	Tag     string   `json:"tag"`     // content tag, see metaCacheTags
+}
+
+// Purge removes the cached objects of bucket selected by q and returns
+// their cache keys, or only returns the keys if dryRun is true. Purging
+// by prefix or tag requires s.Cache to be an IndexedCache.
+func (s *Storage) Purge(ctx context.Context, bucket string, q *PurgeQuery, dryRun bool) ([]string, error) {
+	if q.Prefix == "" && len(q.Objects) == 0 && q.Tag == "" {
+		return nil, fmt.Errorf("purge: empty query")
 	}
-	res, err := httpClient(ctx, scopeStorageRead).Do(req)
-	if err != nil {
-		return nil, err
+	if s.Cache == nil {
+		return nil, nil
+	}
+	ic, indexed := s.Cache.(IndexedCache)
+	if !indexed && (q.Prefix != "" || q.Tag != "") {
+		return nil, fmt.Errorf("purge: cache can't list keys")
+	}
+
+	// keys of the current version and bucket
+	base := s.CacheKey(ctx, bucket, "") + "/"
+	seen := make(map[string]bool)
+	var keys []string
+	add := func(ks ...string) {
+		for _, k := range ks {
+			if !seen[k] && strings.HasPrefix(k, base) {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
 	}
-	if res.StatusCode > 399 {
-		// FetchError takes precedence over i/o errors
-		b, _ := ioutil.ReadAll(res.Body)
-		res.Body.Close()
-		return nil, &FetchError{
-			Msg:  fmt.Sprintf("%s: %s", res.Status, b),
-			Code: res.StatusCode,
+	if q.Prefix != "" {
+		ks, err := ic.Keys(ctx, base+strings.TrimPrefix(q.Prefix, "/"))
+		if err != nil {
+			return nil, err
 		}
+		add(ks...)
 	}
-	m := make(map[string]string)
-	for _, k := range objectHeaders {
-		if v := res.Header.Get(k); v != "" {
-			m[k] = v
+	if q.Tag != "" {
+		ks, err := ic.Tagged(ctx, q.Tag)
+		if err != nil {
+			return nil, err
 		}
+		add(ks...)
 	}
-	rc := res.Body
-	if cacheKey != "" && res.ContentLength < cacheItemMax {
-		rc = &objectBuf{
-			Meta: m,
-			r:    res.Body,
-			key:  cacheKey,
-			ctx:  ctx,
+	if len(q.Objects) > 0 {
+		var cached map[string]bool
+		if indexed && dryRun {
+			// only report the keys actually cached
+			ks, err := ic.Keys(ctx, base)
+			if err != nil {
+				return nil, err
+			}
+			cached = make(map[string]bool, len(ks))
+			for _, k := range ks {
+				cached[k] = true
+			}
+		}
+		for _, name := range q.Objects {
+			for _, k := range s.objectKeys(ctx, bucket, strings.TrimPrefix(name, "/")) {
+				if cached == nil || cached[k] {
+					add(k)
+				}
+			}
 		}
 	}
-	o := &Object{
-		Meta: m,
-		Body: rc,
+	sort.Strings(keys)
+	if dryRun {
+		return keys, nil
 	}
-	return o, nil
+	return keys, s.deleteCache(ctx, keys)
 }
 
-func getCache(ctx context.Context, key string) (*Object, error) {
-	var b objectBuf
-	if _, err := memcache.Gob.Get(ctx, key, &b); err != nil {
-		if err != memcache.ErrCacheMiss {
-			log.Printf("[ERROR] memcache.Gob.Get(%q): %v", key, err)
+// cacheKeys returns the keys object name is cached under, including its
+// encoded variants.
+func (s *Storage) cacheKeys(ctx context.Context, bucket, name string) []string {
+	key := s.CacheKey(ctx, bucket, name)
+	keys := []string{key}
+	for _, e := range encodings {
+		keys = append(keys, key+";"+e.name, key+";"+e.name+noSiblingSuffix)
+	}
+	return keys
+}
+
+// objectKeys returns the cacheKeys of object name under all the names it
+// is served as, see PurgeObject.
+func (s *Storage) objectKeys(ctx context.Context, bucket, name string) []string {
+	keys := s.cacheKeys(ctx, bucket, name)
+	if dir, file := path.Split(name); file == s.Index {
+		// "docs/" and "docs" share the key of "docs"
+		keys = append(keys, s.cacheKeys(ctx, bucket, dir)...)
+	}
+	return keys
+}
+
+// deleteCache removes keys from s.Cache.
+func (s *Storage) deleteCache(ctx context.Context, keys []string) error {
+	if s.Cache == nil {
+		return nil
+	}
+	for _, k := range keys {
+		if err := s.Cache.Delete(ctx, k); err != nil {
+			return err
 		}
-		return nil, err
 	}
-	o := &Object{
-		Meta: b.Meta,
-		Body: ioutil.NopCloser(bytes.NewReader(b.Body)),
+	return nil
+}
+
+// cacheTags returns the content tags of an object with metadata meta.
+func cacheTags(meta map[string]string) []string {
+	var tags []string
+	for _, t := range strings.Split(meta[metaCacheTags], ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tags = append(tags, t)
+		}
 	}
-	return o, nil
+	return tags
 }
 
-func purgeCache(ctx context.Context, key string) error {
-	err := memcache.Delete(ctx, key)
-	if err == memcache.ErrCacheMiss {
-		err = nil
+// CacheKey returns a key to cache an object under, computed from
+// bucket and name.
+func (s *Storage) CacheKey(ctx context.Context, bucket, name string) string {
+	// VersionID is stable for the lifetime of a deployed version and changes on each deployment.
+	// It ensures cached objects do not bleed across versions.
+	return fmt.Sprintf("%s/%s", platform.VersionID(ctx), path.Join(bucket, name))
+}
+
+// getCache returns the object cached under key.
+func getCache(ctx context.Context, c Cache, key string) (*objectBuf, error) {
+	v, err := c.Get(ctx, key)
+	if err != nil {
+		if err != ErrCacheMiss {
+			log.Printf("[ERROR] cache.Get(%q): %v", key, err)
+		}
+		return nil, err
 	}
-	return err
+	b := objectBuf{key: key}
+	if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&b); err != nil {
+		log.Printf("[ERROR] gob.Decode(%q): %v", key, err)
+		return nil, err
+	}
+	return &b, nil
 }
 
-func httpClient(ctx context.Context, scopes ...string) *http.Client {
-	t := &oauth2.Transport{
-		Source: AETokenSource(ctx, scopes...),
-		Base:   &urlfetch.Transport{Context: ctx},
+// setCache caches the exported fields of b under b.key.
+func setCache(ctx context.Context, c Cache, b *objectBuf) {
+	var v bytes.Buffer
+	if err := gob.NewEncoder(&v).Encode(b); err != nil {
+		log.Printf("[ERROR] gob.Encode(%q): %v", b.key, err)
+		return
+	}
+	var err error
+	if ic, ok := c.(IndexedCache); ok {
+		err = ic.SetTagged(ctx, b.key, v.Bytes(), b.cacheExpiry(), cacheTags(b.Meta))
+	} else {
+		err = c.Set(ctx, b.key, v.Bytes(), b.cacheExpiry())
+	}
+	if err != nil {
+		log.Printf("[ERROR] cache.Set(%q): %v", b.key, err)
 	}
-	return &http.Client{Transport: t}
 }
 
 // FetchError contains error code and message from a GCS response.
@@ -251,13 +665,9 @@ func (e *FetchError) Error() string {
 	return fmt.Sprintf("FetchError %d: %s", e.Code, e.Msg)
 }
 
-// AETokenSource returns App Engine OAuth2 token source
-// given a context.Context and a slice of scopes.
-// It is a stubbed static token source during testing.
-var AETokenSource = func(ctx context.Context, scope ...string) oauth2.TokenSource {
-	ts, err := google.DefaultTokenSource(ctx, scope...)
-	if err != nil {
-		panic(err)
-	}
-	return ts
+// isNotFound reports whether err is a FetchError of a missing object.
+// Note that GCS may respond with 403 Forbidden for nonexistent objects.
+func isNotFound(err error) bool {
+	ferr, ok := err.(*FetchError)
+	return ok && (ferr.Code == 404 || ferr.Code == 403)
 }
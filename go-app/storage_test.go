@@ -0,0 +1,825 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func newTestStorage() (*Storage, *MemBackend) {
+	mem := &MemBackend{}
+	mem.Put("goa.design", "index.html", map[string]string{"content-type": "text/html"}, []byte("home"))
+	mem.Put("goa.design", "docs/index.html", map[string]string{"content-type": "text/html"}, []byte("docs"))
+	mem.Put("goa.design", "docs/style.css", map[string]string{"content-type": "text/css"}, []byte("body{}"))
+	mem.Put("goa.design", "old", map[string]string{metaRedirect: "/new/", metaRedirectCode: "302"}, nil)
+	mem.Put("goa.design", "moved/index.html", map[string]string{metaRedirect: "https://example.com/"}, nil)
+	s := &Storage{
+		Backend: mem,
+		Index:   "index.html",
+		CORS:    CORS{Origin: []string{"*"}, MaxAge: "86400"},
+	}
+	return s, mem
+}
+
+func TestOpenFile(t *testing.T) {
+	s, _ := newTestStorage()
+	cases := []struct {
+		name     string
+		body     string
+		redirect string
+		code     int
+	}{
+		{"", "home", "", 0},
+		{"docs/", "docs", "", 0},
+		{"docs/index.html", "docs", "", 0},
+		{"docs/style.css", "body{}", "", 0},
+		{"docs", "", "/docs/", 0},
+		{"old", "", "/new/", 0},
+		{"moved", "", "https://example.com/", 0},
+		{"missing", "", "", 404},
+		{"docs/missing.css", "", "", 404},
+	}
+	for _, c := range cases {
+		o, err := s.OpenFile(context.Background(), "goa.design", c.name)
+		if c.code != 0 {
+			ferr, ok := err.(*FetchError)
+			if !ok || ferr.Code != c.code {
+				t.Errorf("%q: got error %v, want code %d", c.name, err, c.code)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", c.name, err)
+			continue
+		}
+		if r := o.Redirect(); r != c.redirect {
+			t.Errorf("%q: got redirect %q, want %q", c.name, r, c.redirect)
+		}
+		if c.body != "" {
+			b, _ := io.ReadAll(o.Body)
+			if string(b) != c.body {
+				t.Errorf("%q: got body %q, want %q", c.name, b, c.body)
+			}
+		}
+		o.Body.Close()
+	}
+}
+
+func TestServeObject(t *testing.T) {
+	s, _ := newTestStorage()
+	cases := []struct {
+		method, name string
+		origin       string
+		code         int
+		location     string
+		body         string
+		allowOrigin  string
+	}{
+		{"GET", "docs/style.css", "", 200, "", "body{}", "*"},
+		{"HEAD", "docs/style.css", "", 200, "", "", "*"},
+		{"GET", "docs/style.css", "https://example.com", 200, "", "body{}", "*"},
+		{"OPTIONS", "docs/style.css", "https://example.com", 200, "", "", "*"},
+		{"GET", "docs", "", 301, "/docs/", "", "*"},
+		{"GET", "old", "", 302, "/new/", "", "*"},
+		{"OPTIONS", "old", "", 200, "", "", "*"},
+	}
+	for _, c := range cases {
+		o, err := s.OpenFile(context.Background(), "goa.design", c.name)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		r := httptest.NewRequest(c.method, "/"+c.name, nil)
+		if c.origin != "" {
+			r.Header.Set("origin", c.origin)
+		}
+		rec := httptest.NewRecorder()
+		if err := s.ServeObject(rec, r, o); err != nil {
+			t.Errorf("%s %s: %v", c.method, c.name, err)
+		}
+		o.Body.Close()
+		if rec.Code != c.code {
+			t.Errorf("%s %s: got status %d, want %d", c.method, c.name, rec.Code, c.code)
+		}
+		if l := rec.Header().Get("location"); l != c.location {
+			t.Errorf("%s %s: got location %q, want %q", c.method, c.name, l, c.location)
+		}
+		if b := rec.Body.String(); b != c.body {
+			t.Errorf("%s %s: got body %q, want %q", c.method, c.name, b, c.body)
+		}
+		if a := rec.Header().Get("access-control-allow-origin"); a != c.allowOrigin {
+			t.Errorf("%s %s: got allow-origin %q, want %q", c.method, c.name, a, c.allowOrigin)
+		}
+	}
+}
+
+func TestDirBackend(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "docs"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "docs", "index.html"), []byte("docs"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s := &Storage{Backend: &DirBackend{Root: root}, Index: "index.html"}
+	o, err := s.OpenFile(context.Background(), "goa.design", "docs/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(o.Body)
+	o.Body.Close()
+	if string(b) != "docs" {
+		t.Errorf("got body %q, want %q", b, "docs")
+	}
+	if ct := o.Meta["content-type"]; ct != "text/html; charset=utf-8" {
+		t.Errorf("got content-type %q", ct)
+	}
+	if o, err := s.OpenFile(context.Background(), "goa.design", "docs"); err != nil || o.Redirect() != "/docs/" {
+		t.Errorf("got %v, %v; want redirect to /docs/", o, err)
+	}
+	for _, name := range []string{"missing", "../etc/passwd", "docs/index.html/x"} {
+		if _, err := s.Open(context.Background(), "goa.design", name); err == nil {
+			t.Errorf("%q: expected error", name)
+		} else if ferr, ok := err.(*FetchError); !ok || ferr.Code != http.StatusNotFound {
+			t.Errorf("%q: got %v, want 404", name, err)
+		}
+	}
+	names, err := s.List(context.Background(), "goa.design", "docs/")
+	if err != nil || len(names) != 1 || names[0] != "docs/index.html" {
+		t.Errorf("got %v, %v", names, err)
+	}
+}
+
+func TestMemBackendList(t *testing.T) {
+	_, mem := newTestStorage()
+	mem.Put("other", "docs/x", nil, nil)
+	names, err := mem.List(context.Background(), "goa.design", "docs/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 || names[0] != "docs/index.html" || names[1] != "docs/style.css" {
+		t.Errorf("got %v", names)
+	}
+	mem.Delete("goa.design", "docs/style.css")
+	if _, err := mem.Stat(context.Background(), "goa.design", "docs/style.css"); err == nil {
+		t.Error("expected error after delete")
+	}
+}
+
+func TestMemBackendOpenDelete(t *testing.T) {
+	ctx := context.Background()
+	mem := &MemBackend{}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10000; i++ {
+			mem.Put("goa.design", "a", nil, []byte("a"))
+			mem.Delete("goa.design", "a")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10000; i++ {
+			if o, err := mem.Open(ctx, "goa.design", "a"); err == nil {
+				o.Body.Close()
+			}
+		}
+	}()
+	wg.Wait()
+	mem.Put("goa.design", "a", nil, []byte("a"))
+	o, err := mem.Stat(ctx, "goa.design", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mem.OpenIfNoneMatch(ctx, "goa.design", "a", o.Meta["etag"]); err != ErrNotModified {
+		t.Errorf("current etag: got %v, want ErrNotModified", err)
+	}
+	if o, err := mem.OpenIfNoneMatch(ctx, "goa.design", "a", `"old"`); err != nil {
+		t.Errorf("old etag: %v", err)
+	} else {
+		o.Body.Close()
+	}
+}
+
+// countingBackend counts the requests made to its Backend.
+type countingBackend struct {
+	*MemBackend
+	mu                  sync.Mutex
+	opens, conditionals int
+}
+
+func (b *countingBackend) Open(ctx context.Context, bucket, name string) (*Object, error) {
+	b.mu.Lock()
+	b.opens++
+	b.mu.Unlock()
+	return b.MemBackend.Open(ctx, bucket, name)
+}
+
+func (b *countingBackend) OpenIfNoneMatch(ctx context.Context, bucket, name, etag string) (*Object, error) {
+	b.mu.Lock()
+	b.conditionals++
+	b.mu.Unlock()
+	return b.MemBackend.OpenIfNoneMatch(ctx, bucket, name, etag)
+}
+
+func TestStorageRevalidate(t *testing.T) {
+	ctx := context.Background()
+	s, mem := newTestStorage()
+	backend := &countingBackend{MemBackend: mem}
+	s.Backend = backend
+	s.Cache = NewLRUCache(1 << 20)
+	s.MaxAge = time.Hour
+
+	read := func() string {
+		t.Helper()
+		o, err := s.Open(ctx, "goa.design", "docs/style.css")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer o.Body.Close()
+		b, _ := io.ReadAll(o.Body)
+		return string(b)
+	}
+	age := func(d time.Duration) {
+		key := s.CacheKey(ctx, "goa.design", "docs/style.css")
+		b, err := getCache(ctx, s.Cache, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Fetched = b.Fetched.Add(-d)
+		setCache(ctx, s.Cache, b)
+	}
+
+	read()
+	read()
+	if backend.opens != 1 || backend.conditionals != 0 {
+		t.Fatalf("fresh: got %d opens, %d conditionals", backend.opens, backend.conditionals)
+	}
+
+	// stale and unchanged
+	age(2 * time.Hour)
+	if got := read(); got != "body{}" {
+		t.Errorf("got %q", got)
+	}
+	if backend.opens != 1 || backend.conditionals != 1 {
+		t.Fatalf("unchanged: got %d opens, %d conditionals", backend.opens, backend.conditionals)
+	}
+	read()
+	if backend.conditionals != 1 {
+		t.Fatalf("revalidated object not refreshed: got %d conditionals", backend.conditionals)
+	}
+
+	// stale and changed
+	mem.Put("goa.design", "docs/style.css", map[string]string{"content-type": "text/css"}, []byte("p{}"))
+	age(2 * time.Hour)
+	if got := read(); got != "p{}" {
+		t.Errorf("got %q, want updated body", got)
+	}
+	if got := read(); got != "p{}" || backend.conditionals != 2 {
+		t.Errorf("got %q and %d conditionals", got, backend.conditionals)
+	}
+
+	// stale and deleted
+	mem.Delete("goa.design", "docs/style.css")
+	age(2 * time.Hour)
+	if _, err := s.Open(ctx, "goa.design", "docs/style.css"); err == nil {
+		t.Error("expected error for deleted object")
+	}
+}
+
+// flakyBackend fails with err when set, and blocks opens until release
+// is closed when set.
+type flakyBackend struct {
+	*countingBackend
+	mu      sync.Mutex
+	err     error
+	release chan struct{}
+}
+
+func (b *flakyBackend) state() (error, chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err, b.release
+}
+
+func (b *flakyBackend) Open(ctx context.Context, bucket, name string) (*Object, error) {
+	err, release := b.state()
+	if release != nil {
+		<-release
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b.countingBackend.Open(ctx, bucket, name)
+}
+
+func (b *flakyBackend) OpenIfNoneMatch(ctx context.Context, bucket, name, etag string) (*Object, error) {
+	err, release := b.state()
+	if release != nil {
+		<-release
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b.countingBackend.OpenIfNoneMatch(ctx, bucket, name, etag)
+}
+
+func TestStorageStale(t *testing.T) {
+	ctx := context.Background()
+	s, mem := newTestStorage()
+	backend := &flakyBackend{countingBackend: &countingBackend{MemBackend: mem}}
+	s.Backend = backend
+	s.Cache = NewLRUCache(1 << 20)
+	s.MaxAge = time.Hour
+	s.StaleWhileRevalidate = time.Hour
+	s.StaleIfError = 24 * time.Hour
+	key := s.CacheKey(ctx, "goa.design", "docs/style.css")
+
+	read := func() (string, error) {
+		t.Helper()
+		o, err := s.Open(ctx, "goa.design", "docs/style.css")
+		if err != nil {
+			return "", err
+		}
+		defer o.Body.Close()
+		b, _ := io.ReadAll(o.Body)
+		return string(b), nil
+	}
+	age := func(d time.Duration) {
+		b, err := getCache(ctx, s.Cache, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Fetched = time.Now().Add(-d)
+		setCache(ctx, s.Cache, b)
+	}
+	waitRefresh := func() {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			if _, busy := s.refreshing.Load(key); !busy {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("background revalidation did not complete")
+	}
+
+	read()
+	if s.cacheExpiry() != 25*time.Hour {
+		t.Errorf("got cache expiry %v, want 25h", s.cacheExpiry())
+	}
+
+	// stale while revalidate: the stale object is served right away
+	mem.Put("goa.design", "docs/style.css", map[string]string{"content-type": "text/css"}, []byte("p{}"))
+	age(90 * time.Minute)
+	backend.mu.Lock()
+	backend.release = make(chan struct{})
+	backend.mu.Unlock()
+	for i := 0; i < 3; i++ {
+		if got, _ := read(); got != "body{}" {
+			t.Errorf("stale while revalidate: got %q, want stale body", got)
+		}
+	}
+	backend.mu.Lock()
+	close(backend.release)
+	backend.release = nil
+	backend.mu.Unlock()
+	waitRefresh()
+	if backend.conditionals != 1 {
+		t.Errorf("got %d conditional requests, want a single background revalidation", backend.conditionals)
+	}
+	if got, _ := read(); got != "p{}" {
+		t.Errorf("after background revalidation: got %q", got)
+	}
+
+	// stale if error
+	backend.err = &FetchError{Msg: "unavailable", Code: 503}
+	age(3 * time.Hour)
+	if got, err := read(); err != nil || got != "p{}" {
+		t.Errorf("stale if error: got %q, %v", got, err)
+	}
+	backend.err = context.DeadlineExceeded
+	if got, err := read(); err != nil || got != "p{}" {
+		t.Errorf("stale if timeout: got %q, %v", got, err)
+	}
+	age(26 * time.Hour)
+	if _, err := read(); err == nil {
+		t.Error("past stale if error window: expected error")
+	}
+
+	// errors during background revalidation keep the stale object
+	backend.err = &FetchError{Msg: "unavailable", Code: 503}
+	age(90 * time.Minute)
+	if got, _ := read(); got != "p{}" {
+		t.Errorf("stale while revalidate with error: got %q", got)
+	}
+	waitRefresh()
+	if got, err := read(); err != nil || got != "p{}" {
+		t.Errorf("after failed background revalidation: got %q, %v", got, err)
+	}
+}
+
+func TestStorageStaleEncode(t *testing.T) {
+	// run with -race: the background revalidation must not share the
+	// meta of the objects served meanwhile
+	ctx := context.Background()
+	s, mem := newTestStorage()
+	mem.Put("goa.design", "docs/app.css", map[string]string{"content-type": "text/css"}, bytes.Repeat([]byte("p{}"), 1000))
+	s.Cache = NewLRUCache(1 << 20)
+	s.MaxAge = time.Hour
+	s.StaleWhileRevalidate = time.Hour
+	key := s.CacheKey(ctx, "goa.design", "docs/app.css")
+	r := httptest.NewRequest("GET", "/docs/app.css", nil)
+	r.Header.Set("accept-encoding", "gzip")
+
+	for i := 0; i < 10; i++ {
+		o, err := s.Open(ctx, "goa.design", "docs/app.css")
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, o.Body)
+		o.Body.Close()
+		b, err := getCache(ctx, s.Cache, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Fetched = time.Now().Add(-90 * time.Minute)
+		setCache(ctx, s.Cache, b)
+
+		o, err = s.Open(ctx, "goa.design", "docs/app.css")
+		if err != nil {
+			t.Fatal(err)
+		}
+		o = s.encodeObject(ctx, r, "goa.design", o)
+		o.Body.Close()
+		for j := 0; j < 100; j++ {
+			if _, busy := s.refreshing.Load(key); !busy {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestStorageRevalidateErrors(t *testing.T) {
+	ctx := context.Background()
+	s, mem := newTestStorage()
+	backend := &flakyBackend{countingBackend: &countingBackend{MemBackend: mem}}
+	s.Backend = backend
+	s.Cache = NewLRUCache(1 << 20)
+	s.MaxAge = time.Hour
+	key := s.CacheKey(ctx, "goa.design", "docs/style.css")
+
+	cases := []struct {
+		code    int
+		evicted bool
+	}{
+		{401, false},
+		{429, false},
+		{403, true},
+		{404, true},
+		{410, true},
+	}
+	for _, c := range cases {
+		backend.err = nil
+		o, err := s.Open(ctx, "goa.design", "docs/style.css")
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, o.Body)
+		o.Body.Close()
+		b, err := getCache(ctx, s.Cache, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Fetched = time.Now().Add(-2 * time.Hour)
+		setCache(ctx, s.Cache, b)
+
+		backend.err = &FetchError{Msg: http.StatusText(c.code), Code: c.code}
+		if _, err := s.Open(ctx, "goa.design", "docs/style.css"); err == nil {
+			t.Errorf("%d: expected error", c.code)
+		}
+		if _, err := getCache(ctx, s.Cache, key); (err == ErrCacheMiss) != c.evicted {
+			t.Errorf("%d: got cache error %v, want evicted %v", c.code, err, c.evicted)
+		}
+	}
+}
+
+func TestStorageFetchCoalesce(t *testing.T) {
+	ctx := context.Background()
+	s, mem := newTestStorage()
+	backend := &flakyBackend{countingBackend: &countingBackend{MemBackend: mem}, release: make(chan struct{})}
+	s.Backend = backend
+	s.Cache = NewLRUCache(1 << 20)
+
+	const n = 20
+	var wg sync.WaitGroup
+	bodies := make([]string, n)
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			o, err := s.Open(ctx, "goa.design", "docs/style.css")
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer o.Body.Close()
+			b, _ := io.ReadAll(o.Body)
+			bodies[i] = string(b)
+		}()
+	}
+	// let the requests pile up on the blocked fetch
+	time.Sleep(50 * time.Millisecond)
+	backend.mu.Lock()
+	close(backend.release)
+	backend.release = nil
+	backend.mu.Unlock()
+	wg.Wait()
+
+	for i := 0; i < n; i++ {
+		if errs[i] != nil || bodies[i] != "body{}" {
+			t.Errorf("request %d: got %q, %v", i, bodies[i], errs[i])
+		}
+	}
+	if backend.opens != 1 {
+		t.Errorf("got %d backend requests, want 1", backend.opens)
+	}
+	if _, err := getCache(ctx, s.Cache, s.CacheKey(ctx, "goa.design", "docs/style.css")); err != nil {
+		t.Errorf("object not cached: %v", err)
+	}
+
+	// failures are shared too, and not cached
+	backend.err = &FetchError{Msg: "unavailable", Code: 503}
+	if _, err := s.Open(ctx, "goa.design", "docs/missing.css"); err == nil {
+		t.Error("expected error")
+	}
+	if len(s.flights) != 0 {
+		t.Errorf("got %d flights after completion", len(s.flights))
+	}
+
+	// waiters give up with their request
+	backend.err = nil
+	backend.mu.Lock()
+	backend.release = make(chan struct{})
+	backend.mu.Unlock()
+	cctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := s.Open(cctx, "goa.design", "docs/index.html"); err != context.DeadlineExceeded {
+		t.Errorf("canceled request: got %v, want deadline exceeded", err)
+	}
+	backend.mu.Lock()
+	close(backend.release)
+	backend.release = nil
+	backend.mu.Unlock()
+}
+
+// unsizedBackend hides the size of the objects of its Backend, as with
+// chunked responses.
+type unsizedBackend struct {
+	Backend
+}
+
+func (b unsizedBackend) Open(ctx context.Context, bucket, name string) (*Object, error) {
+	o, err := b.Backend.Open(ctx, bucket, name)
+	if err == nil {
+		o.Size = -1
+	}
+	return o, err
+}
+
+func TestStorageFetchLarge(t *testing.T) {
+	ctx := context.Background()
+	s, mem := newTestStorage()
+	large := bytes.Repeat([]byte("x"), cacheObjectMax+1)
+	mem.Put("goa.design", "large.bin", nil, large)
+	s.Cache = NewLRUCache(1 << 20)
+
+	for _, b := range []Backend{mem, unsizedBackend{mem}} {
+		backend := &flakyBackend{countingBackend: &countingBackend{MemBackend: mem}}
+		if _, ok := b.(unsizedBackend); ok {
+			s.Backend = unsizedBackend{backend}
+		} else {
+			s.Backend = backend
+		}
+		read := func() {
+			t.Helper()
+			o, err := s.Open(ctx, "goa.design", "large.bin")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer o.Body.Close()
+			body, _ := io.ReadAll(o.Body)
+			if !bytes.Equal(body, large) {
+				t.Errorf("got %d bytes, want %d", len(body), len(large))
+			}
+		}
+
+		// the response of the shared fetch is not discarded
+		for i := 0; i < 3; i++ {
+			read()
+		}
+		if backend.opens != 3 {
+			t.Errorf("%T: got %d backend requests for 3 reads, want 3", b, backend.opens)
+		}
+
+		// concurrent requests
+		backend.opens = 0
+		backend.mu.Lock()
+		backend.release = make(chan struct{})
+		backend.mu.Unlock()
+		var wg sync.WaitGroup
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				read()
+			}()
+		}
+		time.Sleep(50 * time.Millisecond)
+		backend.mu.Lock()
+		close(backend.release)
+		backend.release = nil
+		backend.mu.Unlock()
+		wg.Wait()
+		if backend.opens != 3 {
+			t.Errorf("%T: got %d backend requests for 3 concurrent reads, want 3", b, backend.opens)
+		}
+	}
+}
+
+func TestStorageFetchLease(t *testing.T) {
+	ctx := context.Background()
+	cache := NewLRUCache(1 << 20)
+	// two instances sharing a cache
+	s1, mem := newTestStorage()
+	s1.Cache = cache
+	s2, _ := newTestStorage()
+	backend := &countingBackend{MemBackend: mem}
+	s2.Backend = backend
+	s2.Cache = cache
+	key := s1.CacheKey(ctx, "goa.design", "docs/style.css")
+
+	// s1 holds the lease and caches the object meanwhile
+	if !acquireLease(ctx, cache, key+"#lease", fetchLeaseTTL) {
+		t.Fatal("lease not acquired")
+	}
+	if acquireLease(ctx, cache, key+"#lease", fetchLeaseTTL) {
+		t.Fatal("lease acquired twice")
+	}
+	go func() {
+		time.Sleep(3 * fetchLeasePoll / 2)
+		o, _ := mem.Open(ctx, "goa.design", "docs/style.css")
+		body, _ := io.ReadAll(o.Body)
+		setCache(ctx, cache, &objectBuf{Meta: o.Meta, Body: body, Fetched: time.Now(), key: key})
+	}()
+	o, err := s2.Open(ctx, "goa.design", "docs/style.css")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(o.Body)
+	if string(b) != "body{}" || backend.opens != 0 {
+		t.Errorf("got %q with %d backend requests, want the object cached by the lease holder", b, backend.opens)
+	}
+
+	// the lease is released without caching the object, e.g. on errors
+	key = s1.CacheKey(ctx, "goa.design", "docs/index.html")
+	acquireLease(ctx, cache, key+"#lease", fetchLeaseTTL)
+	go func() {
+		time.Sleep(fetchLeasePoll / 2)
+		cache.Delete(ctx, key+"#lease")
+	}()
+	if _, err := s2.Open(ctx, "goa.design", "docs/index.html"); err != nil {
+		t.Fatal(err)
+	}
+	if backend.opens != 1 {
+		t.Errorf("got %d backend requests after the lease was released, want 1", backend.opens)
+	}
+	if _, err := cache.Get(ctx, key+"#lease"); err != ErrCacheMiss {
+		t.Errorf("lease not released: %v", err)
+	}
+}
+
+// statBackend delays or fails the Stat requests of its MemBackend, and
+// reports those abandoned by their caller on canceled.
+type statBackend struct {
+	*MemBackend
+	delay    time.Duration
+	err      error
+	canceled chan string
+}
+
+func (b *statBackend) Stat(ctx context.Context, bucket, name string) (*Object, error) {
+	select {
+	case <-time.After(b.delay):
+	case <-ctx.Done():
+		b.canceled <- name
+		return nil, ctx.Err()
+	}
+	if b.err != nil {
+		return nil, b.err
+	}
+	return b.MemBackend.Stat(ctx, bucket, name)
+}
+
+func TestOpenFileIndex(t *testing.T) {
+	s, mem := newTestStorage()
+	backend := &statBackend{MemBackend: mem, canceled: make(chan string, 1)}
+	s.Backend = backend
+	s.IndexTimeout = 100 * time.Millisecond
+	open := func(ctx context.Context, name string) (*Object, error, time.Duration) {
+		t.Helper()
+		start := time.Now()
+		o, err := s.OpenFile(ctx, "goa.design", name)
+		return o, err, time.Since(start)
+	}
+	is404 := func(err error) bool {
+		ferr, ok := err.(*FetchError)
+		return ok && ferr.Code == 404
+	}
+
+	// slow index within the budget
+	backend.delay = 20 * time.Millisecond
+	if o, err, _ := open(context.Background(), "docs"); err != nil || o.Redirect() != "/docs/" {
+		t.Errorf("slow index: got %v, want redirect to /docs/", err)
+	}
+
+	// the stat is canceled when the object itself is found
+	backend.delay = time.Hour
+	if o, err, _ := open(context.Background(), "old"); err != nil || o.Redirect() != "/new/" {
+		t.Errorf("object found: got %v, want redirect to /new/", err)
+	}
+	select {
+	case name := <-backend.canceled:
+		if name != "old/index.html" {
+			t.Errorf("canceled stat of %q", name)
+		}
+	case <-time.After(time.Second):
+		t.Error("object found: stat not canceled")
+	}
+
+	// the index times out
+	if _, err, d := open(context.Background(), "docs"); !is404(err) || d > time.Second {
+		t.Errorf("index timeout: got %v after %v, want 404 after %v", err, d, s.IndexTimeout)
+	}
+	<-backend.canceled
+
+	// the request context expires first
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err, d := open(ctx, "docs"); err != context.DeadlineExceeded || d >= s.IndexTimeout {
+		t.Errorf("request deadline: got %v after %v, want deadline exceeded", err, d)
+	}
+	<-backend.canceled
+
+	// failing index
+	backend.delay = 0
+	backend.err = &FetchError{Msg: "unavailable", Code: 503}
+	if _, err, _ := open(context.Background(), "docs"); !is404(err) {
+		t.Errorf("failing index: got %v, want the original 404", err)
+	}
+}
+
+func TestGCSBackendCancel(t *testing.T) {
+	defer func(f func(context.Context, ...string) oauth2.TokenSource) { AETokenSource = f }(AETokenSource)
+	AETokenSource = func(context.Context, ...string) oauth2.TokenSource {
+		return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token"})
+	}
+	canceled := make(chan string, 1)
+	gcs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			// hang until the client gives up
+			<-r.Context().Done()
+			canceled <- r.URL.Path
+			return
+		}
+		io.WriteString(w, "the docs")
+	}))
+	defer gcs.Close()
+	s := &Storage{Backend: &GCSBackend{Base: gcs.URL}, Index: "index.html"}
+
+	o, err := s.OpenFile(context.Background(), "goa.design", "docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.Body.Close()
+	select {
+	case p := <-canceled:
+		if p != "/goa.design/docs/index.html" {
+			t.Errorf("canceled request for %q", p)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("index request not canceled")
+	}
+}
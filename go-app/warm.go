@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WarmOptions configures Storage.Warm.
+type WarmOptions struct {
+	Sitemap     string        // sitemap object name, defaults to "sitemap.xml"
+	Pages       int           // max pages to warm, by sitemap priority, defaults to 50
+	Concurrency int           // max concurrent fetches, defaults to 8
+	Budget      time.Duration // max duration of the warm-up, defaults to 30s
+}
+
+// WarmReport summarizes a cache warm-up.
+type WarmReport struct {
+	Pages    int      `json:"pages"`    // pages selected from the sitemap
+	Assets   int      `json:"assets"`   // assets referenced by the pages
+	Warmed   int      `json:"warmed"`   // objects read into cache
+	Failed   int      `json:"failed"`   // objects which couldn't be read
+	Skipped  int      `json:"skipped"`  // objects not fetched within the budget
+	Duration string   `json:"duration"` // time spent
+	Errors   []string `json:"errors,omitempty"`
+}
+
+// warmOptions returns the WarmOptions configured by the WARM_PAGES,
+// WARM_CONCURRENCY and WARM_BUDGET environment variables.
+func warmOptions() (WarmOptions, error) {
+	var opt WarmOptions
+	for name, p := range map[string]*int{"WARM_PAGES": &opt.Pages, "WARM_CONCURRENCY": &opt.Concurrency} {
+		if v := os.Getenv(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return opt, fmt.Errorf("invalid %s %q", name, v)
+			}
+			*p = n
+		}
+	}
+	if v := os.Getenv("WARM_BUDGET"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return opt, fmt.Errorf("invalid WARM_BUDGET %q", v)
+		}
+		opt.Budget = d
+	}
+	return opt, nil
+}
+
+// Warm populates s.Cache with the top pages listed in the sitemap of
+// bucket, and the assets they reference, reading them through OpenFile.
+func (s *Storage) Warm(ctx context.Context, bucket string, opt WarmOptions) *WarmReport {
+	if opt.Sitemap == "" {
+		opt.Sitemap = "sitemap.xml"
+	}
+	if opt.Pages <= 0 {
+		opt.Pages = 50
+	}
+	if opt.Concurrency <= 0 {
+		opt.Concurrency = 8
+	}
+	if opt.Budget <= 0 {
+		opt.Budget = 30 * time.Second
+	}
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, opt.Budget)
+	defer cancel()
+
+	w := &warmer{s: s, bucket: bucket, sem: make(chan struct{}, opt.Concurrency), seen: make(map[string]bool)}
+	pages, err := w.sitemap(ctx, opt.Sitemap)
+	if err != nil {
+		w.fail(opt.Sitemap, err)
+	}
+	if len(pages) > opt.Pages {
+		pages = pages[:opt.Pages]
+	}
+	w.report.Pages = len(pages)
+
+	// pages first, then the assets they reference
+	assets := w.warmAll(ctx, pages, true)
+	w.report.Assets = len(assets)
+	w.warmAll(ctx, assets, false)
+	w.report.Duration = time.Since(start).Round(time.Millisecond).String()
+	return &w.report
+}
+
+// warmer holds the state of a warm-up.
+type warmer struct {
+	s      *Storage
+	bucket string
+	sem    chan struct{} // bounds concurrent fetches
+
+	mu     sync.Mutex
+	seen   map[string]bool // object names fetched or queued
+	report WarmReport
+}
+
+// warmAll reads the objects names concurrently and returns the assets
+// referenced by the HTML pages among them if links is true, once each.
+func (w *warmer) warmAll(ctx context.Context, names []string, links bool) []string {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		refs = make(map[string]bool)
+	)
+	for _, name := range names {
+		w.mu.Lock()
+		seen := w.seen[name]
+		w.seen[name] = true
+		w.mu.Unlock()
+		if seen {
+			continue
+		}
+		if !w.acquire(ctx) {
+			w.mu.Lock()
+			w.report.Skipped++
+			w.mu.Unlock()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-w.sem }()
+			body, err := w.read(ctx, name, links)
+			if err != nil {
+				w.fail(name, err)
+				return
+			}
+			w.mu.Lock()
+			w.report.Warmed++
+			w.mu.Unlock()
+			if links {
+				mu.Lock()
+				for _, ref := range pageAssets(name, body) {
+					refs[ref] = true
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assets := make([]string, 0, len(refs))
+	for ref := range refs {
+		assets = append(assets, ref)
+	}
+	sort.Strings(assets)
+	return assets
+}
+
+// acquire waits for a fetch slot and reports whether it got one before
+// the end of the budget.
+func (w *warmer) acquire(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	select {
+	case w.sem <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// read reads object name through w.s so that it is cached, returning its
+// body if keep is true and the object is an HTML page.
+func (w *warmer) read(ctx context.Context, name string, keep bool) ([]byte, error) {
+	o, err := w.s.OpenFile(ctx, w.bucket, name)
+	if err != nil {
+		return nil, err
+	}
+	defer o.Body.Close()
+	if !keep || !strings.HasPrefix(o.Meta["content-type"], "text/html") {
+		_, err := io.Copy(io.Discard, o.Body)
+		return nil, err
+	}
+	return io.ReadAll(o.Body)
+}
+
+func (w *warmer) fail(name string, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.report.Failed++
+	if len(w.report.Errors) < 10 {
+		w.report.Errors = append(w.report.Errors, fmt.Sprintf("/%s: %v", name, err))
+	}
+}
+
+// sitemapEntry is a <url> or <sitemap> element of a sitemap.
+type sitemapEntry struct {
+	Loc      string  `xml:"loc"`
+	Priority float64 `xml:"priority"`
+}
+
+// sitemap returns the object names of the pages listed by the sitemap
+// object name, highest priority first. Sitemap indexes, such as those of
+// multilingual Hugo sites, are followed one level deep.
+func (w *warmer) sitemap(ctx context.Context, name string) ([]string, error) {
+	entries, sitemaps, err := w.parseSitemap(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, sm := range sitemaps {
+		u, err := url.Parse(sm.Loc)
+		if err != nil {
+			continue
+		}
+		urls, _, err := w.parseSitemap(ctx, strings.TrimPrefix(u.Path, "/"))
+		if err != nil {
+			w.fail(strings.TrimPrefix(u.Path, "/"), err)
+			continue
+		}
+		entries = append(entries, urls...)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Priority > entries[j].Priority
+	})
+	var names []string
+	for _, e := range entries {
+		if u, err := url.Parse(e.Loc); err == nil {
+			names = append(names, strings.TrimPrefix(u.Path, "/"))
+		}
+	}
+	return names, nil
+}
+
+// parseSitemap returns the <url> and <sitemap> entries of the sitemap
+// object name.
+func (w *warmer) parseSitemap(ctx context.Context, name string) (urls, sitemaps []sitemapEntry, err error) {
+	o, err := w.s.Open(ctx, w.bucket, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer o.Body.Close()
+	var doc struct {
+		URLs     []sitemapEntry `xml:"url"`
+		Sitemaps []sitemapEntry `xml:"sitemap"`
+	}
+	if err := xml.NewDecoder(o.Body).Decode(&doc); err != nil {
+		return nil, nil, fmt.Errorf("decode sitemap: %w", err)
+	}
+	return doc.URLs, doc.Sitemaps, nil
+}
+
+// assetRef matches the targets of src and href attributes.
+var assetRef = regexp.MustCompile(`(?i)\b(?:src|href)\s*=\s*["']([^"'#?]+)`)
+
+// pageAssets returns the object names of the same-site assets referenced
+// by the HTML page object name, e.g. stylesheets, scripts and images.
+// Links to other pages are ignored.
+func pageAssets(name string, page []byte) []string {
+	var assets []string
+	for _, m := range assetRef.FindAllSubmatch(page, -1) {
+		ref := string(m[1])
+		u, err := url.Parse(ref)
+		if err != nil || u.Scheme != "" || u.Host != "" || strings.HasPrefix(ref, "//") {
+			continue
+		}
+		p := u.Path
+		if !strings.HasPrefix(p, "/") {
+			p = path.Join("/", path.Dir(name), p)
+		}
+		switch ext := path.Ext(p); ext {
+		case "", ".html", ".htm", ".xml":
+			continue
+		}
+		assets = append(assets, strings.TrimPrefix(path.Clean(p), "/"))
+	}
+	return assets
+}
+
+// serveWarm warms the cache of s, logging and responding with the
+// WarmReport. The options of the POST JSON body, if any, override opt,
+// e.g. {"pages": 10, "budget": "10s"}.
+func serveWarm(s *Storage, bucket string, opt WarmOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		o := opt
+		if r.Method == "POST" && r.ContentLength != 0 {
+			var req struct {
+				Pages       int    `json:"pages"`
+				Concurrency int    `json:"concurrency"`
+				Budget      string `json:"budget"`
+			}
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&req); err != nil {
+				http.Error(w, "malformed warm request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if req.Pages > 0 {
+				o.Pages = req.Pages
+			}
+			if req.Concurrency > 0 {
+				o.Concurrency = req.Concurrency
+			}
+			if req.Budget != "" {
+				d, err := time.ParseDuration(req.Budget)
+				if err != nil {
+					http.Error(w, "malformed warm request: "+err.Error(), http.StatusBadRequest)
+					return
+				}
+				o.Budget = d
+			}
+		}
+		rep := s.Warm(platform.NewContext(r), bucket, o)
+		log.Printf("[INFO] cache warm-up: %d pages, %d assets, %d warmed, %d failed, %d skipped in %s",
+			rep.Pages, rep.Assets, rep.Warmed, rep.Failed, rep.Skipped, rep.Duration)
+		w.Header().Set("content-type", "application/json")
+		w.Header().Set("cache-control", "no-store")
+		json.NewEncoder(w).Encode(rep)
+	}
+}
+
+// serveWarmup handles the App Engine warmup requests sent when instances
+// start, see https://cloud.google.com/appengine/docs/standard/configuring-warmup-requests.
+// Only the first request of an instance warms the cache, later ones get
+// 204 No Content.
+func serveWarmup(s *Storage, bucket string, opt WarmOptions) http.HandlerFunc {
+	var once sync.Once
+	warm := serveWarm(s, bucket, opt)
+	return func(w http.ResponseWriter, r *http.Request) {
+		done := true
+		once.Do(func() {
+			done = false
+			warm(w, r)
+		})
+		if done {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
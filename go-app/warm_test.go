@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSitemapIndex = `<?xml version="1.0" encoding="utf-8"?>
+<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <sitemap><loc>https://goa.design/en/sitemap.xml</loc></sitemap>
+  <sitemap><loc>https://goa.design/ja/sitemap.xml</loc></sitemap>
+</sitemapindex>`
+
+const testSitemapEn = `<?xml version="1.0" encoding="utf-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>https://goa.design/docs/</loc><priority>0.5</priority></url>
+  <url><loc>https://goa.design/</loc><priority>1.0</priority></url>
+  <url><loc>https://goa.design/missing/</loc><priority>0.1</priority></url>
+</urlset>`
+
+const testSitemapJa = `<?xml version="1.0" encoding="utf-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>https://goa.design/ja/</loc><priority>0.8</priority></url>
+</urlset>`
+
+func newWarmStorage() (*Storage, *countingBackend) {
+	s, mem := newTestStorage()
+	html := map[string]string{"content-type": "text/html"}
+	xml := map[string]string{"content-type": "application/xml"}
+	mem.Put("goa.design", "sitemap.xml", xml, []byte(testSitemapIndex))
+	mem.Put("goa.design", "en/sitemap.xml", xml, []byte(testSitemapEn))
+	mem.Put("goa.design", "ja/sitemap.xml", xml, []byte(testSitemapJa))
+	mem.Put("goa.design", "index.html", html, []byte(`<link rel="stylesheet" href="/css/site.css"><a href="/docs/">docs</a>`))
+	mem.Put("goa.design", "docs/index.html", html, []byte(`<link href="style.css"><img src="/img/logo.png?v=2"><script src="https://cdn.example.com/x.js"></script>`))
+	mem.Put("goa.design", "ja/index.html", html, []byte(`<link rel="stylesheet" href="/css/site.css">`))
+	mem.Put("goa.design", "css/site.css", map[string]string{"content-type": "text/css"}, []byte("body{}"))
+	mem.Put("goa.design", "img/logo.png", map[string]string{"content-type": "image/png"}, []byte("png"))
+	backend := &countingBackend{MemBackend: mem}
+	s.Backend = backend
+	s.Cache = NewLRUCache(1 << 20)
+	return s, backend
+}
+
+func TestWarm(t *testing.T) {
+	ctx := context.Background()
+	s, backend := newWarmStorage()
+	rep := s.Warm(ctx, "goa.design", WarmOptions{Pages: 3, Concurrency: 2})
+	// the 3 top pages reference 3 assets, css/site.css twice
+	want := WarmReport{Pages: 3, Assets: 3, Warmed: 6, Duration: rep.Duration}
+	if !reflect.DeepEqual(*rep, want) {
+		t.Errorf("got report %+v, want %+v", *rep, want)
+	}
+
+	backend.opens = 0
+	for _, name := range []string{"", "ja/", "docs/", "css/site.css", "docs/style.css", "img/logo.png"} {
+		o, err := s.OpenFile(ctx, "goa.design", name)
+		if err != nil {
+			t.Fatalf("%q: %v", name, err)
+		}
+		o.Body.Close()
+	}
+	if backend.opens != 0 {
+		t.Errorf("got %d backend opens after warm-up, want 0", backend.opens)
+	}
+
+	rep = s.Warm(ctx, "goa.design", WarmOptions{})
+	if rep.Pages != 4 || rep.Failed != 1 || len(rep.Errors) != 1 || !strings.HasPrefix(rep.Errors[0], "/missing/") {
+		t.Errorf("all pages: got report %+v", *rep)
+	}
+}
+
+func TestWarmBudget(t *testing.T) {
+	s, _ := newWarmStorage()
+	s.Backend = &slowBackend{Backend: s.Backend, delay: 50 * time.Millisecond}
+	start := time.Now()
+	rep := s.Warm(context.Background(), "goa.design", WarmOptions{Concurrency: 1, Budget: 200 * time.Millisecond})
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("warm-up took %v", d)
+	}
+	// the 3 sitemaps take 150ms, leaving time for a page at most
+	if rep.Pages != 4 || rep.Skipped == 0 || rep.Warmed+rep.Failed+rep.Skipped != 4 {
+		t.Errorf("got report %+v, want pages skipped", *rep)
+	}
+}
+
+// slowBackend delays Open calls of Backend, failing when ctx is done first.
+type slowBackend struct {
+	Backend
+	delay time.Duration
+}
+
+func (b *slowBackend) Open(ctx context.Context, bucket, name string) (*Object, error) {
+	select {
+	case <-time.After(b.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return b.Backend.Open(ctx, bucket, name)
+}
+
+func TestPageAssets(t *testing.T) {
+	page := []byte(`<link href="/css/a.css"><link href='b.css'><script src="../js/c.js"></script>
+<a href="/docs/">docs</a><a href="page.html">page</a><img src="//cdn.example.com/d.png">
+<img src="https://goa.design/e.png"><img SRC="f.svg#icon"><a href="#top">top</a>`)
+	got := pageAssets("docs/guide/index.html", page)
+	want := []string{"css/a.css", "docs/guide/b.css", "docs/js/c.js", "docs/guide/f.svg"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestServeWarmup(t *testing.T) {
+	s, _ := newWarmStorage()
+	h := serveWarmup(s, "goa.design", WarmOptions{Pages: 1})
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest("GET", "/_ah/warmup", nil))
+	var rep WarmReport
+	if err := json.NewDecoder(rec.Body).Decode(&rep); err != nil {
+		t.Fatal(err)
+	}
+	if rep.Pages != 1 || rep.Warmed != 2 {
+		t.Errorf("got report %+v", rep)
+	}
+	rec = httptest.NewRecorder()
+	h(rec, httptest.NewRequest("GET", "/_ah/warmup", nil))
+	if rec.Code != 204 {
+		t.Errorf("second warmup: got status %d, want 204", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	serveWarm(s, "goa.design", WarmOptions{})(rec, httptest.NewRequest("POST", "/_admin/warm", strings.NewReader(`{"pages": 2, "budget": "5s"}`)))
+	if err := json.NewDecoder(rec.Body).Decode(&rep); err != nil {
+		t.Fatal(err)
+	}
+	if rep.Pages != 2 {
+		t.Errorf("admin warm: got report %+v", rep)
+	}
+}